@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/radudd/custom-ca-inject/pkg/mutate"
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
+)
+
+// buildTruststore merges the base CAs and the custom CAs selected by the filter into PEM, JKS and PKCS#12 truststores
+// It runs in the init containers added to the pods
+func buildTruststore(args []string) error {
+	flags := flag.NewFlagSet("build-truststore", flag.ExitOnError)
+	base := flags.String("base", mutate.DefaultBaseBundle, "PEM bundle of the CAs trusted besides the custom CAs, empty to trust only the custom CAs")
+	custom := flags.String("custom", "", "PEM bundle of the custom CAs")
+	pemOut := flags.String("pem", "", "PEM truststore to write")
+	jksOut := flags.String("jks", "", "JKS truststore to write")
+	pkcs12Out := flags.String("pkcs12", "", "PKCS#12 truststore to write")
+	mode := flags.String("mode", "0644", "Permissions of the truststores, in octal, e.g. 0440 to make them readable by the group only")
+	password := flags.String("password", truststore.DefaultPassword, "Password of the JKS and PKCS#12 truststores, overridden by the "+truststore.PasswordEnv+" environment variable")
+	newFilter := filterFlags(flags)
+	flags.Parse(args)
+
+	if *custom == "" {
+		return fmt.Errorf("-custom is required")
+	}
+	if *pemOut == "" && *jksOut == "" && *pkcs12Out == "" {
+		return fmt.Errorf("At least one of -pem, -jks and -pkcs12 is required")
+	}
+	perm, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil || os.FileMode(perm)&^os.ModePerm != 0 {
+		return fmt.Errorf("-mode %q is not an octal file mode, e.g. 0644", *mode)
+	}
+	// the init containers get the password from a secret through the environment, to keep it out of the pod spec
+	if env, ok := os.LookupEnv(truststore.PasswordEnv); ok {
+		*password = env
+	}
+	filter, err := newFilter()
+	if err != nil {
+		return err
+	}
+
+	var baseCerts []*x509.Certificate
+	if *base != "" {
+		if baseCerts, err = readBundle(*base); err != nil {
+			return err
+		}
+	}
+	customCerts, err := readBundle(*custom)
+	if err != nil {
+		return err
+	}
+	if customCerts, err = selectCertificates(filter, customCerts, *custom); err != nil {
+		return err
+	}
+	entries := truststore.Merge(baseCerts, customCerts)
+	fmt.Printf("Merged %d base and %d custom certificates into %d entries\n", len(baseCerts), len(customCerts), len(entries))
+
+	if *pemOut != "" {
+		if err := writeTruststore(*pemOut, truststore.EncodePEM(truststore.Certificates(entries)), os.FileMode(perm)); err != nil {
+			return fmt.Errorf("Failed to write PEM truststore: %v", err)
+		}
+		fmt.Printf("Wrote PEM truststore %s\n", *pemOut)
+	}
+	if *jksOut != "" {
+		jks, err := truststore.EncodeJKS(entries, *password, time.Now())
+		if err != nil {
+			return fmt.Errorf("Failed to encode JKS truststore: %v", err)
+		}
+		if err := writeTruststore(*jksOut, jks, os.FileMode(perm)); err != nil {
+			return fmt.Errorf("Failed to write JKS truststore: %v", err)
+		}
+		fmt.Printf("Wrote JKS truststore %s\n", *jksOut)
+	}
+	if *pkcs12Out != "" {
+		pkcs12, err := truststore.EncodePKCS12(entries, *password)
+		if err != nil {
+			return fmt.Errorf("Failed to encode PKCS#12 truststore: %v", err)
+		}
+		if err := writeTruststore(*pkcs12Out, pkcs12, os.FileMode(perm)); err != nil {
+			return fmt.Errorf("Failed to write PKCS#12 truststore: %v", err)
+		}
+		fmt.Printf("Wrote PKCS#12 truststore %s\n", *pkcs12Out)
+	}
+	return nil
+}
+
+// writeTruststore writes the truststore with exactly the permissions perm, whatever the umask
+func writeTruststore(file string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(file, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(file, perm)
+}
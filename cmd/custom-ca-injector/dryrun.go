@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/radudd/custom-ca-inject/pkg/config"
+	"github.com/radudd/custom-ca-inject/pkg/mutate"
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// dryRun runs a Pod or an AdmissionReview read from a file or stdin through the mutation
+// and prints the effective settings, the JSON patch and the patched Pod
+func dryRun(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("dry-run", flag.ExitOnError)
+	file := flags.String("f", "-", "Pod or AdmissionReview to mutate, as YAML or JSON, - to read stdin")
+	configFile := flags.String("config", "", "Path of the configuration file providing the injection defaults, the built-in defaults are used if empty")
+	namespace := flags.String("namespace", "", "Namespace of the Pod, defaults to its metadata.namespace")
+	flags.Parse(args)
+
+	// keep stdout for the result
+	logrus.SetOutput(os.Stderr)
+
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			return err
+		}
+	}
+	cfg.Apply()
+
+	var input []byte
+	var err error
+	if *file == "-" {
+		input, err = ioutil.ReadAll(stdin)
+	} else {
+		input, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read input: %v", err)
+	}
+
+	review, pod, err := dryRunReview(input, *namespace)
+	if err != nil {
+		return err
+	}
+	result, err := mutate.DryRun(review)
+	if err != nil {
+		return err
+	}
+	if !result.Response.Allowed {
+		return fmt.Errorf("Pod denied: %s", result.Response.Result.Message)
+	}
+
+	patch := result.Response.Patch
+	if len(patch) == 0 {
+		patch = []byte("[]")
+	}
+	patchedPod, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return fmt.Errorf("Failed to decode the patch: %v", err)
+	}
+	patchedJSON, err := patchedPod.Apply(pod)
+	if err != nil {
+		return fmt.Errorf("Failed to apply the patch: %v", err)
+	}
+
+	settingsYAML, err := yaml.Marshal(result.Settings)
+	if err != nil {
+		return err
+	}
+	containersYAML, err := yaml.Marshal(result.Containers)
+	if err != nil {
+		return err
+	}
+	var patchJSON bytes.Buffer
+	if err := json.Indent(&patchJSON, patch, "", "  "); err != nil {
+		return err
+	}
+	podYAML, err := yaml.JSONToYAML(patchedJSON)
+	if err != nil {
+		return err
+	}
+
+	if result.Settings == nil {
+		fmt.Fprintln(stdout, "# Effective settings: pod is not marked for injection")
+	} else {
+		fmt.Fprintf(stdout, "# Effective settings\n%s", settingsYAML)
+		fmt.Fprintf(stdout, "---\n# Effective settings of the selected containers\n%s", containersYAML)
+	}
+	fmt.Fprintf(stdout, "---\n# JSON patch\n%s\n", patchJSON.String())
+	fmt.Fprintf(stdout, "---\n# Patched Pod\n%s", podYAML)
+	return nil
+}
+
+// dryRunReview returns the AdmissionReview to send to the mutation and the Pod it contains
+// A Pod is wrapped in a v1 AdmissionReview for its creation
+func dryRunReview(input []byte, namespace string) ([]byte, []byte, error) {
+	inputJSON, err := yaml.YAMLToJSON(input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode input: %v", err)
+	}
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(inputJSON, &typeMeta); err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode input: %v", err)
+	}
+
+	switch typeMeta.Kind {
+	case "AdmissionReview":
+		// the request is the same for all the supported versions
+		ar := struct {
+			Request *struct {
+				Object json.RawMessage `json:"object"`
+			} `json:"request"`
+		}{}
+		if err := json.Unmarshal(inputJSON, &ar); err != nil {
+			return nil, nil, fmt.Errorf("Failed to decode AdmissionReview: %v", err)
+		}
+		if ar.Request == nil {
+			return nil, nil, fmt.Errorf("AdmissionReview has no request")
+		}
+		return inputJSON, ar.Request.Object, nil
+	case "Pod":
+		pod := struct {
+			metav1.ObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(inputJSON, &pod); err != nil {
+			return nil, nil, fmt.Errorf("Failed to decode Pod: %v", err)
+		}
+		if namespace == "" {
+			namespace = pod.Namespace
+		}
+		review, err := json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: admissionv1.SchemeGroupVersion.String(),
+				Kind:       "AdmissionReview",
+			},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "dry-run",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+				Name:      pod.Name,
+				Namespace: namespace,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: inputJSON},
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return review, inputJSON, nil
+	default:
+		return nil, nil, fmt.Errorf("Input must be a Pod or an AdmissionReview, got kind %q", typeMeta.Kind)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/radudd/custom-ca-inject/pkg/mutate"
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
+)
+
+// filterFlags defines the flags of the certificate filter and returns the function compiling it
+func filterFlags(flags *flag.FlagSet) func() (*truststore.Filter, error) {
+	regexCn := flags.String("regex-cn", "", "Regex the subject CN must match")
+	regexIssuer := flags.String("regex-issuer", "", "Regex the issuer DN must match")
+	regexIssuerDeny := flags.String("regex-issuer-deny", "", "Regex the issuer DN must not match")
+	fingerprintAllow := flags.String("fingerprint-allow", "", "Comma separated SHA-256 fingerprints of the only certificates selected")
+	fingerprintDeny := flags.String("fingerprint-deny", "", "Comma separated SHA-256 fingerprints of the certificates never selected")
+	return func() (*truststore.Filter, error) {
+		return truststore.NewFilter(*regexCn, *regexIssuer, *regexIssuerDeny, mutate.SplitList(*fingerprintAllow), mutate.SplitList(*fingerprintDeny))
+	}
+}
+
+// readBundle returns the certificates of a PEM bundle, a bundle without certificates is an error
+func readBundle(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read bundle: %v", err)
+	}
+	certs, err := truststore.ParsePEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", file, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificate found in %s", file)
+	}
+	return certs, nil
+}
+
+// selectCertificates applies the filter to the certificates read from file
+// It fails if the filter selects none of them, as an empty selection is always a mistake in the filter
+func selectCertificates(filter *truststore.Filter, certs []*x509.Certificate, file string) ([]*x509.Certificate, error) {
+	selected := filter.Select(certs)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("None of the %d certificates of %s is selected by the filter", len(certs), file)
+	}
+	for _, cert := range selected {
+		fmt.Printf("Selected %s (SHA-256 %s)\n", cert.Subject, truststore.Fingerprint(cert))
+	}
+	return selected, nil
+}
+
+// filterBundle writes the certificates of a PEM bundle selected by the filter rules to a new bundle
+// It allows to check the filter annotations of a pod against a bundle
+func filterBundle(args []string) error {
+	flags := flag.NewFlagSet("filter-bundle", flag.ExitOnError)
+	in := flags.String("in", "", "PEM bundle to filter")
+	out := flags.String("out", "", "PEM bundle to write the selected certificates to")
+	newFilter := filterFlags(flags)
+	flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+	filter, err := newFilter()
+	if err != nil {
+		return err
+	}
+	certs, err := readBundle(*in)
+	if err != nil {
+		return err
+	}
+	selected, err := selectCertificates(filter, certs, *in)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, truststore.EncodePEM(selected), 0644); err != nil {
+		return fmt.Errorf("Failed to write bundle: %v", err)
+	}
+	fmt.Printf("Wrote %d of %d certificates to %s\n", len(selected), len(certs), *out)
+	return nil
+}
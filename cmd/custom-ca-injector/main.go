@@ -1,39 +1,207 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/radudd/custom-ca-inject/pkg/certs"
+	"github.com/radudd/custom-ca-inject/pkg/config"
+	"github.com/radudd/custom-ca-inject/pkg/health"
+	"github.com/radudd/custom-ca-inject/pkg/kube"
 	"github.com/radudd/custom-ca-inject/pkg/mutate"
 	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
 )
 
-func handleMutate(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "POST":
-		body, err := ioutil.ReadAll(r.Body)
-		defer r.Body.Close()
-		if err != nil {
-			responsewriters.InternalError(w, r, fmt.Errorf("Failed to read body: %v", err))
-			return
+// handleAdmission serves an admission webhook answering the AdmissionReview with review
+func handleAdmission(review func([]byte) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			body, err := ioutil.ReadAll(r.Body)
+			defer r.Body.Close()
+			if err != nil {
+				responsewriters.InternalError(w, r, fmt.Errorf("Failed to read body: %v", err))
+				return
+			}
+
+			// decisions on the pod, including rejections, are answered in the AdmissionReview
+			// an error means the body could not be answered as an AdmissionReview at all
+			answer, err := review(body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid AdmissionReview: %v", err), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(answer)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
+	}
+}
+
+// subcommands run instead of the webhook server when named as first argument
+var subcommands = map[string]func(args []string) error{
+	"dry-run": func(args []string) error {
+		return dryRun(args, os.Stdin, os.Stdout)
+	},
+	"filter-bundle":    filterBundle,
+	"build-truststore": buildTruststore,
+}
+
+var configFile = flag.String("config", "", "Path of the configuration file, the built-in defaults are used if empty")
+
+// certificateSource provides the serving certificate
+type certificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	Ready() error
+}
 
-		mutated, err := mutate.Mutate(body)
+// newCertificateSource sets up the source of the serving certificate
+// By default the key pair mounted from the secret is served and reloaded whenever the secret is rotated
+// In self-managed mode, the CA shared by the replicas in a secret issues the serving certificate and is published to the webhook configuration
+func newCertificateSource(cfg *config.Configuration, stop <-chan struct{}) (certificateSource, error) {
+	if !cfg.SelfManagedTLS.Enabled {
+		reloader, err := certs.NewReloader(cfg.Server.CertFile, cfg.Server.KeyFile)
 		if err != nil {
-			responsewriters.InternalError(w, r, fmt.Errorf("Failed mutation: %v", err))
-			return
+			return nil, err
 		}
-		//responsewriters.WriteRawJSON(200, mutated, w)
-		w.WriteHeader(http.StatusOK)
-		w.Write(mutated)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		go reloader.Watch(certs.DefaultReloadInterval, stop)
+		return reloader, nil
 	}
+
+	namespace := cfg.SelfManagedTLS.ServiceNamespace
+	if namespace == "" {
+		var err error
+		if namespace, err = kube.Namespace(); err != nil {
+			return nil, err
+		}
+	}
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	authority, err := certs.NewAuthority(certs.ServiceDNSNames(cfg.SelfManagedTLS.ServiceName, namespace), certs.DefaultCAValidity, certs.DefaultServingValidity)
+	if err != nil {
+		return nil, err
+	}
+	targets := []certs.WebhookTarget{
+		{Resource: "mutatingwebhookconfigurations", Name: cfg.SelfManagedTLS.MutatingWebhookName},
+	}
+	if cfg.SelfManagedTLS.ValidatingWebhookName != "" {
+		targets = append(targets, certs.WebhookTarget{Resource: "validatingwebhookconfigurations", Name: cfg.SelfManagedTLS.ValidatingWebhookName})
+	}
+	secret := certs.CASecret{Namespace: namespace, Name: cfg.SelfManagedTLS.CASecretName}
+	go authority.Run(client, secret, targets, certs.DefaultReconcileInterval, stop)
+	return authority, nil
 }
 
 func main() {
-	http.HandleFunc("/mutate", handleMutate)
-	log.Fatal(http.ListenAndServeTLS(":8443", "/ssl/tls.crt", "/ssl/tls.key", nil))
-}
\ No newline at end of file
+	// subcommands are handled before the flags of the webhook server
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flag.Parse()
+
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.Apply()
+
+	stop := make(chan struct{})
+	if *configFile != "" {
+		go config.Watch(*configFile, cfg, config.DefaultReloadInterval, stop)
+	}
+
+	// the inject label of a namespace opts its pods in or out, it is not read outside of a cluster
+	if client, err := kube.NewInClusterClient(); err != nil {
+		log.Printf("The labels of the namespaces are not read: %v", err)
+	} else {
+		mutate.ConfigureNamespaceLabels(kube.NewNamespaceLabels(client, kube.DefaultNamespaceLabelsTTL).Get)
+	}
+
+	source, err := newCertificateSource(cfg, stop)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	checker := health.NewChecker()
+	checker.Add("certificate", source.Ready)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", handleAdmission(mutate.Mutate))
+	mux.HandleFunc("/validate", handleAdmission(mutate.Validate))
+	mux.HandleFunc("/healthz", checker.Healthz)
+	mux.HandleFunc("/readyz", checker.Readyz)
+	server := &http.Server{
+		Addr:    cfg.Server.Address,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: source.GetCertificate,
+		},
+	}
+
+	serverErrors := make(chan error, 2)
+	go func() {
+		serverErrors <- server.ListenAndServeTLS("", "")
+	}()
+
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.Server.MetricsAddress,
+			Handler: metricsMux,
+		}
+		go func() {
+			serverErrors <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serverErrors:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	// Fail readiness first and keep serving while the pod is removed from the endpoints,
+	// then stop accepting connections and wait for the in-flight admission requests
+	checker.ShutDown()
+	time.Sleep(cfg.Server.ShutdownDelay.Duration)
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalf("Failed to drain in-flight requests: %v", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
+	log.Print("Shut down gracefully")
+}
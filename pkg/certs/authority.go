@@ -0,0 +1,302 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/radudd/custom-ca-inject/pkg/kube"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCAValidity defines how long the self-managed CA is valid
+	DefaultCAValidity = 365 * 24 * time.Hour
+
+	// DefaultServingValidity defines how long the serving certificate issued by the self-managed CA is valid
+	DefaultServingValidity = 30 * 24 * time.Hour
+
+	// DefaultReconcileInterval defines how often certificates are checked for rotation
+	// and the caBundle of the webhook configurations is checked for drift
+	DefaultReconcileInterval = time.Minute
+)
+
+// keyPair is a certificate together with its private key
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// Authority is a self-managed CA issuing the serving certificate of the webhook
+// Certificates are rotated once two thirds of their validity elapsed. A rotated CA is kept
+// in the CA bundle until it expires, so the API server trusts both the old and the new serving certificate
+// The CAs are shared by the replicas through a secret, each replica issues its own serving certificate
+type Authority struct {
+	dnsNames        []string
+	caValidity      time.Duration
+	servingValidity time.Duration
+
+	mu      sync.RWMutex
+	cas     []*keyPair
+	serving *tls.Certificate
+	leaf    *x509.Certificate
+	// published is set once the CA bundle was written to all targets
+	published bool
+}
+
+// NewAuthority generates a CA and a serving certificate valid for dnsNames
+// The CA is replaced by the one of the secret shared by the replicas on the first reconciliation, if there is one
+func NewAuthority(dnsNames []string, caValidity, servingValidity time.Duration) (*Authority, error) {
+	a := &Authority{
+		dnsNames:        dnsNames,
+		caValidity:      caValidity,
+		servingValidity: servingValidity,
+	}
+	now := time.Now()
+	if _, err := a.rotateCA(now); err != nil {
+		return nil, err
+	}
+	if _, err := a.rotateServing(now); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ServiceDNSNames returns the names under which the API server reaches the webhook service
+func ServiceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+// GetCertificate returns the current serving certificate, it is meant to be used as tls.Config.GetCertificate
+func (a *Authority) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.serving, nil
+}
+
+// CABundle returns the PEM encoded CAs which must be trusted by the API server
+func (a *Authority) CABundle() []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var bundle bytes.Buffer
+	for _, ca := range a.cas {
+		bundle.Write(ca.pem)
+	}
+	return bundle.Bytes()
+}
+
+// Ready reports an error until the CA was published to the webhook configurations
+// Before that the API server does not trust the serving certificate
+func (a *Authority) Ready() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.published {
+		return fmt.Errorf("CA bundle not yet published to the webhook configurations")
+	}
+	return nil
+}
+
+// Run keeps the certificates rotated, the CAs in sync with the secret and the caBundle of the targets in sync until stop is closed
+// A serving certificate issued by a new CA is only used once the CA was published to all targets
+func (a *Authority) Run(client *kube.Client, secret CASecret, targets []WebhookTarget, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.reconcile(client, secret, targets, time.Now()); err != nil {
+			log.Errorf("Unable to reconcile the webhook certificates: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Authority) reconcile(client *kube.Client, secret CASecret, targets []WebhookTarget, now time.Time) error {
+	rotated, err := a.syncCAs(client, secret, now)
+	if err != nil {
+		return err
+	}
+	if rotated {
+		log.Info("Rotated the self-managed CA")
+	}
+
+	bundle := a.CABundle()
+	for _, target := range targets {
+		if err := ReconcileCABundle(client, target, bundle); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	a.published = true
+	a.mu.Unlock()
+
+	rotated, err = a.rotateServing(now)
+	if err != nil {
+		return err
+	}
+	if rotated {
+		log.Info("Rotated the serving certificate")
+	}
+	return nil
+}
+
+// syncCAs adopts the CAs of the secret, then rotates them and stores them back in the secret when due
+// The secret is created with the CAs of this replica if it does not exist. If another replica created or
+// updated it in the meantime, its CAs are adopted instead, so that all the replicas publish the same caBundle
+func (a *Authority) syncCAs(client *kube.Client, secret CASecret, now time.Time) (bool, error) {
+	stored, resourceVersion, err := loadCAs(client, secret)
+	if err != nil {
+		return false, err
+	}
+	if stored != nil {
+		a.mu.Lock()
+		a.cas = stored
+		a.mu.Unlock()
+	}
+	rotated, err := a.rotateCA(now)
+	if err != nil {
+		return false, err
+	}
+	if stored != nil && !rotated {
+		return false, nil
+	}
+
+	a.mu.RLock()
+	cas := a.cas
+	a.mu.RUnlock()
+	err = saveCAs(client, secret, cas, resourceVersion)
+	if !kube.IsConflict(err) {
+		return rotated, err
+	}
+	log.Info("The self-managed CA was updated by another replica, adopting it")
+	if stored, _, err = loadCAs(client, secret); err != nil {
+		return false, err
+	}
+	if stored == nil {
+		return false, fmt.Errorf("Secret %s/%s was deleted while being updated", secret.Namespace, secret.Name)
+	}
+	a.mu.Lock()
+	a.cas = stored
+	a.mu.Unlock()
+	return false, nil
+}
+
+// rotateCA drops expired CAs and generates a new one when the newest CA is due for rotation
+func (a *Authority) rotateCA(now time.Time) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var valid []*keyPair
+	for _, ca := range a.cas {
+		if now.Before(ca.cert.NotAfter) {
+			valid = append(valid, ca)
+		}
+	}
+	a.cas = valid
+
+	if len(a.cas) > 0 && !dueForRotation(a.cas[len(a.cas)-1].cert, now) {
+		return false, nil
+	}
+
+	ca, err := newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("custom-ca-injector-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(a.caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	if err != nil {
+		return false, fmt.Errorf("Failed to generate CA: %v", err)
+	}
+	a.cas = append(a.cas, ca)
+	return true, nil
+}
+
+// rotateServing issues a new serving certificate when the current one is due for rotation
+// or was not signed by the newest CA
+func (a *Authority) rotateServing(now time.Time) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ca := a.cas[len(a.cas)-1]
+	// the signature is checked as two replicas may generate CAs with the same subject, e.g. when starting together
+	if a.leaf != nil && !dueForRotation(a.leaf, now) && a.leaf.CheckSignatureFrom(ca.cert) == nil {
+		return false, nil
+	}
+
+	serving, err := newKeyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: a.dnsNames[0]},
+		DNSNames:    a.dnsNames,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(a.servingValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	if err != nil {
+		return false, fmt.Errorf("Failed to issue serving certificate: %v", err)
+	}
+	a.serving = &tls.Certificate{
+		Certificate: [][]byte{serving.cert.Raw, ca.cert.Raw},
+		PrivateKey:  serving.key,
+		Leaf:        serving.cert,
+	}
+	a.leaf = serving.cert
+	return true, nil
+}
+
+// dueForRotation reports if two thirds of the certificate validity elapsed
+func dueForRotation(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// newKeyPair generates a key and a certificate from template signed by parent
+// The certificate is self-signed if parent is nil
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
@@ -0,0 +1,231 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/radudd/custom-ca-inject/pkg/kube"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func bundleCAs(t *testing.T, bundle []byte) []*x509.Certificate {
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		cas = append(cas, ca)
+	}
+	return cas
+}
+
+func TestAuthorityIssuesTrustedServingCertificate(t *testing.T) {
+	a, err := NewAuthority(ServiceDNSNames("custom-ca-injector", "injector"), DefaultCAValidity, DefaultServingValidity)
+	assert.NoError(t, err)
+
+	cas := bundleCAs(t, a.CABundle())
+	assert.Len(t, cas, 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cas[0])
+	cert, _ := a.GetCertificate(nil)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "custom-ca-injector.injector.svc", Roots: pool})
+	assert.NoError(t, err)
+}
+
+func TestAuthorityRotation(t *testing.T) {
+	a, err := NewAuthority([]string{"custom-ca-injector.injector.svc"}, 3*time.Hour, time.Hour)
+	assert.NoError(t, err)
+	first, _ := a.GetCertificate(nil)
+	now := time.Now()
+
+	// nothing is due yet
+	rotated, err := a.rotateCA(now)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+	rotated, err = a.rotateServing(now)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	// the serving certificate is due before the CA
+	rotated, err = a.rotateServing(now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	second, _ := a.GetCertificate(nil)
+	assert.NotEqual(t, first.Leaf.SerialNumber, second.Leaf.SerialNumber)
+
+	// a rotated CA is kept in the bundle next to the previous one
+	rotated, err = a.rotateCA(now.Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	cas := bundleCAs(t, a.CABundle())
+	assert.Len(t, cas, 2)
+
+	// the serving certificate is reissued by the new CA
+	rotated, err = a.rotateServing(now.Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	third, _ := a.GetCertificate(nil)
+	assert.Equal(t, cas[1].RawSubject, third.Leaf.RawIssuer)
+
+	// expired CAs are dropped from the bundle
+	_, err = a.rotateCA(now.Add(3 * time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, bundleCAs(t, a.CABundle()), 1)
+}
+
+const (
+	testWebhookPath = "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/custom-ca-injector-pki"
+	testSecretsPath = "/api/v1/namespaces/injector/secrets"
+)
+
+// fakeAPIServer serves a mutating webhook configuration and the CA secret
+type fakeAPIServer struct {
+	mu              sync.Mutex
+	webhook         []byte
+	secret          *corev1.Secret
+	resourceVersion int
+	// beforeWrite is run once before the first write of the secret, e.g. to let another replica write first
+	beforeWrite func()
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	return &fakeAPIServer{webhook: []byte(`{"webhooks": [{"name": "custompki.openshift.io", "clientConfig": {}}]}`)}
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method == "POST" || r.Method == "PUT" {
+		f.mu.Lock()
+		beforeWrite := f.beforeWrite
+		f.beforeWrite = nil
+		f.mu.Unlock()
+		if beforeWrite != nil {
+			beforeWrite()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == testWebhookPath && r.Method == "GET":
+		w.Write(f.webhook)
+	case r.URL.Path == testWebhookPath && r.Method == "PATCH":
+		patch, err := jsonpatch.DecodePatch(body)
+		if err == nil {
+			f.webhook, err = patch.Apply(f.webhook)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Write(f.webhook)
+	case r.URL.Path == testSecretsPath+"/custom-ca-injector-ca" && r.Method == "GET":
+		if f.secret == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.secret)
+	case r.URL.Path == testSecretsPath && r.Method == "POST", r.URL.Path == testSecretsPath+"/custom-ca-injector-ca" && r.Method == "PUT":
+		secret := &corev1.Secret{}
+		json.Unmarshal(body, secret)
+		if (r.Method == "POST" && f.secret != nil) || (r.Method == "PUT" && (f.secret == nil || secret.ResourceVersion != f.secret.ResourceVersion)) {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		f.resourceVersion++
+		secret.ResourceVersion = strconv.Itoa(f.resourceVersion)
+		f.secret = secret
+		json.NewEncoder(w).Encode(f.secret)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// caBundle returns the caBundle of the webhook
+func (f *fakeAPIServer) caBundle(t *testing.T) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config := webhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(f.webhook, &config))
+	return config.Webhooks[0].ClientConfig.CABundle
+}
+
+// assertTrusted checks that the serving certificates of the authorities are trusted with the CA bundle at now
+func assertTrusted(t *testing.T, bundle []byte, now time.Time, authorities ...*Authority) {
+	pool := x509.NewCertPool()
+	for _, ca := range bundleCAs(t, bundle) {
+		pool.AddCert(ca)
+	}
+	for i, a := range authorities {
+		assert.Equal(t, string(bundle), string(a.CABundle()), "authority %d", i)
+		cert, _ := a.GetCertificate(nil)
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "custom-ca-injector.injector.svc", Roots: pool, CurrentTime: now})
+		assert.NoError(t, err, "authority %d", i)
+	}
+}
+
+func TestAuthoritiesShareTheCA(t *testing.T) {
+	f := newFakeAPIServer()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	client := kube.NewClient(server.URL, "", server.Client())
+	secret := CASecret{Namespace: "injector", Name: "custom-ca-injector-ca"}
+	targets := []WebhookTarget{{Resource: "mutatingwebhookconfigurations", Name: "custom-ca-injector-pki"}}
+
+	var authorities []*Authority
+	for i := 0; i < 2; i++ {
+		a, err := NewAuthority(ServiceDNSNames("custom-ca-injector", "injector"), DefaultCAValidity, DefaultServingValidity)
+		assert.NoError(t, err)
+		authorities = append(authorities, a)
+	}
+	old, updated := authorities[0], authorities[1]
+	now := time.Now()
+
+	// replicas reconciling in turn, e.g. during a rolling update, publish the same CA
+	for _, a := range []*Authority{old, updated, old, updated} {
+		assert.NoError(t, a.reconcile(client, secret, targets, now))
+	}
+	assertTrusted(t, f.caBundle(t), now, old, updated)
+	assert.Equal(t, "1", f.secret.ResourceVersion)
+
+	// a CA rotated by a replica is adopted by the other one
+	later := now.Add(DefaultCAValidity*2/3 + time.Hour)
+	assert.NoError(t, updated.reconcile(client, secret, targets, later))
+	assert.NoError(t, old.reconcile(client, secret, targets, later))
+	assert.Len(t, bundleCAs(t, f.caBundle(t)), 2)
+	assertTrusted(t, f.caBundle(t), later, old, updated)
+	assert.Equal(t, "2", f.secret.ResourceVersion)
+}
+
+func TestAuthoritiesStartingTogetherAdoptTheFirstCA(t *testing.T) {
+	f := newFakeAPIServer()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	client := kube.NewClient(server.URL, "", server.Client())
+	secret := CASecret{Namespace: "injector", Name: "custom-ca-injector-ca"}
+	targets := []WebhookTarget{{Resource: "mutatingwebhookconfigurations", Name: "custom-ca-injector-pki"}}
+
+	first, err := NewAuthority(ServiceDNSNames("custom-ca-injector", "injector"), DefaultCAValidity, DefaultServingValidity)
+	assert.NoError(t, err)
+	second, err := NewAuthority(ServiceDNSNames("custom-ca-injector", "injector"), DefaultCAValidity, DefaultServingValidity)
+	assert.NoError(t, err)
+	now := time.Now()
+
+	// the second replica creates the secret between the read and the write of the first one
+	f.beforeWrite = func() {
+		assert.NoError(t, second.reconcile(client, secret, targets, now))
+	}
+	assert.NoError(t, first.reconcile(client, secret, targets, now))
+	assert.Len(t, bundleCAs(t, f.caBundle(t)), 1)
+	assertTrusted(t, f.caBundle(t), now, first, second)
+}
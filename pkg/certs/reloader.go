@@ -0,0 +1,122 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReloadInterval defines how often the mounted key pair is checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// Reloader serves a TLS key pair loaded from disk and swaps it in whenever the files change
+// The secret volume is updated by the kubelet through a symlink swap, hence the files are
+// polled instead of relying on inotify events which are lost when the link is replaced
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// NewReloader loads the key pair from certFile and keyFile
+// It fails if the initial key pair cannot be loaded
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current key pair, it is meant to be used as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Ready reports an error if no valid certificate is served
+func (r *Reloader) Ready() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return fmt.Errorf("certificate not loaded")
+	}
+	if time.Now().After(r.leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", r.leaf.NotAfter)
+	}
+	return nil
+}
+
+// Watch checks the key pair for changes every interval until stop is closed
+// A key pair which cannot be loaded, e.g. because only one of the files was rotated yet,
+// is logged and the previous certificate continues to be served
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := r.reload()
+			if err != nil {
+				log.Errorf("Unable to reload TLS key pair: %v", err)
+				continue
+			}
+			if changed {
+				log.Infof("Reloaded TLS key pair from %s", r.certFile)
+			}
+		}
+	}
+}
+
+// reload reads the key pair and swaps it in if it differs from the one being served
+func (r *Reloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read certificate: %v", err)
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read key: %v", err)
+	}
+
+	r.mu.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse certificate: %v", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.leaf = leaf
+	r.certPEM = certPEM
+	r.keyPEM = keyPEM
+	r.mu.Unlock()
+	return true, nil
+}
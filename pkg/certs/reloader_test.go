@@ -0,0 +1,77 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKeyPair writes a self-signed key pair for commonName to dir
+func writeKeyPair(t *testing.T, dir string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func servedCommonName(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestReloaderSwapsRotatedKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeKeyPair(t, dir, "first")
+	r, err := NewReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", servedCommonName(t, r))
+
+	changed, err := r.reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	writeKeyPair(t, dir, "second")
+	changed, err = r.reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "second", servedCommonName(t, r))
+
+	// a half rotated pair keeps the previous certificate
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.key"), []byte("garbage"), 0600))
+	_, err = r.reload()
+	assert.Error(t, err)
+	assert.Equal(t, "second", servedCommonName(t, r))
+}
+
+func TestReloaderFailsWithoutKeyPair(t *testing.T) {
+	_, err := NewReloader("/nonexistent/tls.crt", "/nonexistent/tls.key")
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/radudd/custom-ca-inject/pkg/kube"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// caBundleKey holds the CAs in the secret, the oldest first
+	caBundleKey = "ca-bundle.crt"
+
+	// caKeyKey holds the key of the newest CA in the secret, the only one signing serving certificates
+	caKeyKey = "ca.key"
+)
+
+// CASecret identifies the secret holding the self-managed CA shared by the replicas of the injector
+type CASecret struct {
+	Namespace string
+	Name      string
+}
+
+func (s CASecret) collectionPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", s.Namespace)
+}
+
+func (s CASecret) path() string {
+	return fmt.Sprintf("%s/%s", s.collectionPath(), s.Name)
+}
+
+// loadCAs returns the CAs stored in the secret and its resourceVersion, no CA if the secret does not exist
+func loadCAs(client *kube.Client, secret CASecret) ([]*keyPair, string, error) {
+	body, err := client.Get(secret.path())
+	if kube.IsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	stored := corev1.Secret{}
+	if err := json.Unmarshal(body, &stored); err != nil {
+		return nil, "", fmt.Errorf("Failed to decode secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	cas, err := decodeCAs(stored.Data[caBundleKey], stored.Data[caKeyKey])
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid CA in secret %s/%s, delete it to generate a new one: %v", secret.Namespace, secret.Name, err)
+	}
+	return cas, stored.ResourceVersion, nil
+}
+
+// saveCAs stores the CAs in the secret, which is created if resourceVersion is empty
+// It fails with a conflict if the secret was created or updated by another replica in the meantime
+func saveCAs(client *kube.Client, secret CASecret, cas []*keyPair, resourceVersion string) error {
+	bundle, key, err := encodeCAs(cas)
+	if err != nil {
+		return err
+	}
+	object, err := json.Marshal(corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            secret.Name,
+			Namespace:       secret.Namespace,
+			ResourceVersion: resourceVersion,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			caBundleKey: bundle,
+			caKeyKey:    key,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if resourceVersion == "" {
+		_, err = client.Create(secret.collectionPath(), object)
+	} else {
+		_, err = client.Update(secret.path(), object)
+	}
+	return err
+}
+
+// encodeCAs returns the PEM bundle of the CAs and the PEM key of the newest one
+func encodeCAs(cas []*keyPair) ([]byte, []byte, error) {
+	var bundle bytes.Buffer
+	for _, ca := range cas {
+		bundle.Write(ca.pem)
+	}
+	der, err := x509.MarshalECPrivateKey(cas[len(cas)-1].key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to encode the CA key: %v", err)
+	}
+	return bundle.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// decodeCAs returns the CAs of the PEM bundle, the newest one with the PEM key
+func decodeCAs(bundle []byte, keyPEM []byte) ([]*keyPair, error) {
+	var cas []*keyPair
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, &keyPair{cert: cert, pem: pem.EncodeToMemory(block)})
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no CA in %s", caBundleKey)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", caKeyKey)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	newest := cas[len(cas)-1]
+	if public, ok := newest.cert.PublicKey.(*ecdsa.PublicKey); !ok || public.X.Cmp(key.X) != 0 || public.Y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("%s is not the key of the last CA of %s", caKeyKey, caBundleKey)
+	}
+	newest.key = key
+	return cas, nil
+}
@@ -0,0 +1,72 @@
+package certs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/radudd/custom-ca-inject/pkg/kube"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebhookTarget identifies a webhook configuration whose caBundle is managed by the injector
+type WebhookTarget struct {
+	// Resource is the plural resource name, e.g. mutatingwebhookconfigurations
+	Resource string
+	// Name is the name of the webhook configuration
+	Name string
+}
+
+// webhookConfiguration holds the fields shared by mutating and validating webhook configurations
+type webhookConfiguration struct {
+	Webhooks []struct {
+		Name         string `json:"name"`
+		ClientConfig struct {
+			CABundle []byte `json:"caBundle,omitempty"`
+		} `json:"clientConfig"`
+	} `json:"webhooks"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ReconcileCABundle sets bundle as caBundle of every webhook of the target which does not already have it
+func ReconcileCABundle(client *kube.Client, target WebhookTarget, bundle []byte) error {
+	path := fmt.Sprintf("/apis/admissionregistration.k8s.io/v1/%s/%s", target.Resource, target.Name)
+	body, err := client.Get(path)
+	if err != nil {
+		return err
+	}
+	config := webhookConfiguration{}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return fmt.Errorf("Failed to decode %s %s: %v", target.Resource, target.Name, err)
+	}
+
+	var patch []patchOperation
+	for i, webhook := range config.Webhooks {
+		if bytes.Equal(webhook.ClientConfig.CABundle, bundle) {
+			continue
+		}
+		// the webhook name is tested to not patch the wrong entry if the list changed in the meantime
+		patch = append(patch,
+			patchOperation{Op: "test", Path: fmt.Sprintf("/webhooks/%d/name", i), Value: webhook.Name},
+			patchOperation{Op: "add", Path: fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i), Value: bundle},
+		)
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Patch(path, "application/json-patch+json", patchBytes); err != nil {
+		return err
+	}
+	log.Infof("Updated caBundle of %s %s", target.Resource, target.Name)
+	return nil
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/radudd/custom-ca-inject/pkg/mutate"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// APIVersion is the version of the configuration file format
+	APIVersion = "custompki.openshift.io/v1alpha1"
+
+	// Kind is the kind of the configuration file
+	Kind = "InjectorConfiguration"
+
+	// DefaultReloadInterval defines how often the configuration file is checked for changes
+	DefaultReloadInterval = 10 * time.Second
+)
+
+// Configuration is the content of the configuration file of the injector
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// LogLevel is one of the logrus levels, e.g. info or debug
+	LogLevel string `json:"logLevel,omitempty"`
+
+	// Server holds the listen settings, they are only applied at startup
+	Server Server `json:"server"`
+
+	// SelfManagedTLS holds the settings of the self-managed certificates, they are only applied at startup
+	SelfManagedTLS SelfManagedTLS `json:"selfManagedTLS"`
+
+	// Injection holds the defaults used when a pod has no annotation overriding them
+	Injection mutate.Settings `json:"injection"`
+}
+
+// Server holds the listen settings of the webhook server
+type Server struct {
+	// Address is the address serving the webhook over TLS
+	Address string `json:"address"`
+	// CertFile is the serving certificate, reloaded when it changes
+	CertFile string `json:"certFile"`
+	// KeyFile is the key of the serving certificate
+	KeyFile string `json:"keyFile"`
+	// MetricsAddress is the address serving the Prometheus metrics over plain HTTP, empty to disable
+	MetricsAddress string `json:"metricsAddress"`
+	// ShutdownDelay is the time to keep serving after SIGTERM while readiness fails
+	ShutdownDelay metav1.Duration `json:"shutdownDelay"`
+	// ShutdownTimeout is the maximum time to wait for in-flight requests to complete on shutdown
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+}
+
+// SelfManagedTLS holds the settings of the self-managed CA
+type SelfManagedTLS struct {
+	// Enabled generates the CA and serving certificate instead of loading CertFile and KeyFile
+	Enabled bool `json:"enabled"`
+	// ServiceName is the name of the webhook service, used in the serving certificate
+	ServiceName string `json:"serviceName"`
+	// ServiceNamespace is the namespace of the webhook service, defaults to the namespace of the pod
+	ServiceNamespace string `json:"serviceNamespace,omitempty"`
+	// MutatingWebhookName is the name of the MutatingWebhookConfiguration whose caBundle is managed
+	MutatingWebhookName string `json:"mutatingWebhookName"`
+	// ValidatingWebhookName is the name of the ValidatingWebhookConfiguration whose caBundle is managed, empty to skip it
+	ValidatingWebhookName string `json:"validatingWebhookName,omitempty"`
+	// CASecretName is the name of the secret sharing the CA between the replicas, in the namespace of the service
+	CASecretName string `json:"caSecretName"`
+}
+
+// Default returns the configuration used when no configuration file is given
+func Default() *Configuration {
+	return &Configuration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: APIVersion,
+			Kind:       Kind,
+		},
+		Server: Server{
+			Address:         ":8443",
+			CertFile:        "/ssl/tls.crt",
+			KeyFile:         "/ssl/tls.key",
+			MetricsAddress:  ":8080",
+			ShutdownDelay:   metav1.Duration{Duration: 5 * time.Second},
+			ShutdownTimeout: metav1.Duration{Duration: 20 * time.Second},
+		},
+		SelfManagedTLS: SelfManagedTLS{
+			ServiceName:           "custom-ca-injector",
+			MutatingWebhookName:   "custom-ca-injector-pki",
+			ValidatingWebhookName: "custom-ca-injector-validation",
+			CASecretName:          "custom-ca-injector-ca",
+		},
+		Injection: mutate.DefaultSettings(),
+	}
+}
+
+// Load reads and validates the configuration file
+// Settings missing from the file keep their default value
+func Load(file string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read configuration: %v", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates the content of a configuration file
+func Parse(data []byte) (*Configuration, error) {
+	c := Default()
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("Failed to decode configuration: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+// Validate checks the configuration and returns all the problems found
+func (c *Configuration) Validate() error {
+	var errs []string
+	if c.APIVersion != APIVersion || c.Kind != Kind {
+		errs = append(errs, fmt.Sprintf("apiVersion and kind must be %s and %s, got %q and %q", APIVersion, Kind, c.APIVersion, c.Kind))
+	}
+	if c.LogLevel != "" {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			errs = append(errs, fmt.Sprintf("logLevel: %v", err))
+		}
+	}
+
+	if c.Server.Address == "" {
+		errs = append(errs, "server.address must not be empty")
+	}
+	if !c.SelfManagedTLS.Enabled && (c.Server.CertFile == "" || c.Server.KeyFile == "") {
+		errs = append(errs, "server.certFile and server.keyFile are required unless selfManagedTLS is enabled")
+	}
+	if c.Server.ShutdownDelay.Duration < 0 || c.Server.ShutdownTimeout.Duration < 0 {
+		errs = append(errs, "server.shutdownDelay and server.shutdownTimeout must not be negative")
+	}
+
+	if c.SelfManagedTLS.Enabled {
+		for field, name := range map[string]string{
+			"selfManagedTLS.serviceName":         c.SelfManagedTLS.ServiceName,
+			"selfManagedTLS.mutatingWebhookName": c.SelfManagedTLS.MutatingWebhookName,
+			"selfManagedTLS.caSecretName":        c.SelfManagedTLS.CASecretName,
+		} {
+			for _, msg := range validation.IsDNS1123Subdomain(name) {
+				errs = append(errs, fmt.Sprintf("%s %q: %s", field, name, msg))
+			}
+		}
+		if name := c.SelfManagedTLS.ValidatingWebhookName; name != "" {
+			for _, msg := range validation.IsDNS1123Subdomain(name) {
+				errs = append(errs, fmt.Sprintf("selfManagedTLS.validatingWebhookName %q: %s", name, msg))
+			}
+		}
+	}
+
+	for _, msg := range c.Injection.Validate() {
+		errs = append(errs, "injection."+msg)
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Apply applies the settings which can be changed at runtime
+func (c *Configuration) Apply() {
+	if c.LogLevel != "" {
+		level, _ := log.ParseLevel(c.LogLevel)
+		log.SetLevel(level)
+	}
+	mutate.Configure(c.Injection)
+}
+
+// Watch reloads the configuration file every interval until stop is closed
+// A valid configuration is applied, an invalid one is logged and the previous one is kept
+// Server and selfManagedTLS changes require a restart
+func Watch(file string, current *Configuration, interval time.Duration, stop <-chan struct{}) {
+	last, _ := ioutil.ReadFile(file)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("Unable to reload configuration: %v", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		c, err := Parse(data)
+		if err != nil {
+			log.Errorf("Unable to reload configuration, keeping the previous one: %v", err)
+			continue
+		}
+		if c.Server != current.Server || c.SelfManagedTLS != current.SelfManagedTLS {
+			log.Warn("Changes to server and selfManagedTLS are only applied after a restart")
+		}
+		c.Apply()
+		log.Infof("Reloaded configuration from %s", file)
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/radudd/custom-ca-inject/pkg/mutate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeepsDefaultsForMissingSettings(t *testing.T) {
+	c, err := Parse([]byte(`
+apiVersion: custompki.openshift.io/v1alpha1
+kind: InjectorConfiguration
+logLevel: debug
+injection:
+  initContainerImage: mirror.example.com/ubi8/openjdk-11
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "debug", c.LogLevel)
+	assert.Equal(t, "mirror.example.com/ubi8/openjdk-11", c.Injection.InitContainerImage)
+	assert.Equal(t, mutate.DefaultConfigMap, c.Injection.ConfigMap)
+	assert.Equal(t, mutate.DefaultInjectPemPath, c.Injection.InjectPemPath)
+	assert.Equal(t, ":8443", c.Server.Address)
+}
+
+func TestParseRejectsInvalidConfiguration(t *testing.T) {
+	_, err := Parse([]byte(`
+apiVersion: custompki.openshift.io/v1alpha1
+kind: InjectorConfiguration
+logLevel: loud
+injection:
+  configMap: Custom_CA
+  injectJksPath: etc/pki/java
+  injectPkcs12Path: /etc/pki/ca-trust/extracted/pem
+  profileBaseBundles:
+    ubuntu: /etc/ssl/certs/ca-certificates.crt
+    alpine: etc/ssl/cert.pem
+  initContainerMemoryRequest: 128Mi
+`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `injection.configMap "Custom_CA": a DNS-1123 subdomain must consist of lower case alphanumeric characters`)
+	assert.Contains(t, err.Error(), `injection.injectJksPath "etc/pki/java": must be an absolute path`)
+	assert.Contains(t, err.Error(), `injection.initContainerMemoryRequest "128Mi": must not exceed initContainerMemoryLimit "64Mi"`)
+	assert.Contains(t, err.Error(), `injection.injectPkcs12Path "/etc/pki/ca-trust/extracted/pem": must not mount the PKCS12 truststore at /etc/pki/ca-trust/extracted/pem, where the PEM truststore is mounted`)
+	assert.Contains(t, err.Error(), `injection.profileBaseBundles "ubuntu": must be one of alpine, debian, distroless, rhel`)
+	assert.Contains(t, err.Error(), `injection.profileBaseBundles.alpine "etc/ssl/cert.pem": must be an absolute path`)
+	assert.Contains(t, err.Error(), `logLevel: not a valid logrus Level: "loud"`)
+}
+
+func TestParseRejectsUnknownFieldsAndVersions(t *testing.T) {
+	_, err := Parse([]byte(`
+apiVersion: custompki.openshift.io/v1alpha1
+kind: InjectorConfiguration
+injection:
+  image: mirror.example.com/ubi8/openjdk-11
+`))
+	assert.Error(t, err)
+
+	_, err = Parse([]byte(`
+apiVersion: custompki.openshift.io/v2
+kind: InjectorConfiguration
+`))
+	assert.Error(t, err)
+}
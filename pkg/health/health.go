@@ -0,0 +1,73 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Check reports an error while the component it checks is not ready
+type Check func() error
+
+// Checker serves the liveness and readiness endpoints of the webhook server
+// Readiness fails until all registered checks pass, and again once shutdown has started
+// so that the pod is removed from the service endpoints while in-flight requests are drained
+type Checker struct {
+	mu           sync.RWMutex
+	checks       map[string]Check
+	shuttingDown bool
+}
+
+// NewChecker creates a Checker without checks
+func NewChecker() *Checker {
+	return &Checker{checks: map[string]Check{}}
+}
+
+// Add registers a readiness check under name
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// ShutDown marks the server as shutting down, readiness fails from now on
+func (c *Checker) ShutDown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shuttingDown = true
+}
+
+// Healthz answers the liveness probe, the server is alive as long as it answers
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Readyz answers the readiness probe with the list of failed checks
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	if failures := c.failures(); len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(failures, "\n")))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (c *Checker) failures() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.shuttingDown {
+		return []string{"shutting down"}
+	}
+	var failures []string
+	for name, check := range c.checks {
+		if err := check(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(failures)
+	return failures
+}
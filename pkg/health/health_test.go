@@ -0,0 +1,36 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyzFollowsChecksAndShutdown(t *testing.T) {
+	c := NewChecker()
+	ready := fmt.Errorf("certificate not loaded")
+	c.Add("certificate", func() error { return ready })
+
+	rec := httptest.NewRecorder()
+	c.Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "certificate: certificate not loaded", rec.Body.String())
+
+	ready = nil
+	rec = httptest.NewRecorder()
+	c.Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	c.ShutDown()
+	rec = httptest.NewRecorder()
+	c.Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// liveness is not affected by readiness
+	rec = httptest.NewRecorder()
+	c.Healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,151 @@
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials mounted to every pod
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// Client is a minimal client for the K8S API authenticated with the pod's service account
+// The token is read on every request, so bound service account tokens rotated by the kubelet are picked up
+type Client struct {
+	host      string
+	tokenFile string
+	http      *http.Client
+}
+
+// NewInClusterClient creates a Client from the service account mounted in the pod
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("Not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+
+	caPEM, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the cluster CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No certificate found in the cluster CA")
+	}
+
+	return &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// NewClient creates a Client for the API server at host, authenticated with the token read from tokenFile if not empty
+func NewClient(host string, tokenFile string, httpClient *http.Client) *Client {
+	return &Client{
+		host:      host,
+		tokenFile: tokenFile,
+		http:      httpClient,
+	}
+}
+
+// Namespace returns the namespace the pod is running in
+func Namespace() (string, error) {
+	ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the pod namespace: %v", err)
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// Get fetches the object at path and returns its raw JSON
+func (c *Client) Get(path string) ([]byte, error) {
+	return c.do("GET", path, "", nil)
+}
+
+// Patch applies the patch of patchType to the object at path
+func (c *Client) Patch(path string, patchType string, patch []byte) ([]byte, error) {
+	return c.do("PATCH", path, patchType, bytes.NewReader(patch))
+}
+
+// Create posts the JSON object to the collection at path
+func (c *Client) Create(path string, object []byte) ([]byte, error) {
+	return c.do("POST", path, "application/json", bytes.NewReader(object))
+}
+
+// Update replaces the object at path with the JSON object, which fails with a conflict if its resourceVersion is outdated
+func (c *Client) Update(path string, object []byte) ([]byte, error) {
+	return c.do("PUT", path, "application/json", bytes.NewReader(object))
+}
+
+func (c *Client) do(method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, c.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the service account token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed to read the response: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{Method: method, Path: path, Code: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+	return respBody, nil
+}
+
+// StatusError is returned when the API server answers with a status other than 2xx
+type StatusError struct {
+	Method string
+	Path   string
+	Code   int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.Method, e.Path, e.Code, e.Body)
+}
+
+// IsNotFound reports if err is a StatusError for a missing object
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+// IsConflict reports if err is a StatusError for an object which already exists or was modified in the meantime
+func IsConflict(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusConflict
+}
@@ -0,0 +1,65 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultNamespaceLabelsTTL is how long the labels of a namespace are cached
+const DefaultNamespaceLabelsTTL = 30 * time.Second
+
+// NamespaceLabels reads the labels of the namespaces and caches them for ttl,
+// so that the admission of the pods of a namespace does not query the K8S API every time
+type NamespaceLabels struct {
+	client *Client
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	cached map[string]cachedLabels
+}
+
+type cachedLabels struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+// NewNamespaceLabels creates a NamespaceLabels reading the namespaces with client
+func NewNamespaceLabels(client *Client, ttl time.Duration) *NamespaceLabels {
+	return &NamespaceLabels{
+		client: client,
+		ttl:    ttl,
+		now:    time.Now,
+		cached: map[string]cachedLabels{},
+	}
+}
+
+// Get returns the labels of the namespace, read again once the cached ones are older than the ttl
+func (n *NamespaceLabels) Get(name string) (map[string]string, error) {
+	n.mu.Lock()
+	cached, ok := n.cached[name]
+	n.mu.Unlock()
+	if ok && n.now().Sub(cached.fetched) < n.ttl {
+		return cached.labels, nil
+	}
+
+	body, err := n.client.Get("/api/v1/namespaces/" + name)
+	if err != nil {
+		return nil, err
+	}
+	namespace := struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(body, &namespace); err != nil {
+		return nil, fmt.Errorf("Failed to decode namespace %s: %v", name, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cached[name] = cachedLabels{labels: namespace.Metadata.Labels, fetched: n.now()}
+	return namespace.Metadata.Labels, nil
+}
@@ -0,0 +1,48 @@
+package kube
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceLabelsAreCached(t *testing.T) {
+	labels := `{"inject": "custom-pki"}`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/yolo" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		requests++
+		w.Write([]byte(`{"metadata": {"name": "yolo", "labels": ` + labels + `}}`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	namespaces := NewNamespaceLabels(NewClient(server.URL, "", server.Client()), time.Minute)
+	namespaces.now = func() time.Time { return now }
+
+	got, err := namespaces.Get("yolo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"inject": "custom-pki"}, got)
+
+	// the cached labels are returned until they expire
+	labels = `{"inject": "custom-pki", "custompki.openshift.io/inject": "true"}`
+	got, err = namespaces.Get("yolo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"inject": "custom-pki"}, got)
+	assert.Equal(t, 1, requests)
+
+	now = now.Add(time.Minute)
+	got, err = namespaces.Get("yolo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"inject": "custom-pki", "custompki.openshift.io/inject": "true"}, got)
+	assert.Equal(t, 2, requests)
+
+	_, err = namespaces.Get("missing")
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "custom_ca_injector"
+
+const (
+	// ResultMutated is recorded when a patch was returned for the pod
+	ResultMutated = "mutated"
+	// ResultSkipped is recorded when the pod was admitted without changes
+	ResultSkipped = "skipped"
+	// ResultAllowed is recorded when the validating webhook allowed the pod
+	ResultAllowed = "allowed"
+	// ResultDenied is recorded when the pod was denied, e.g. for invalid annotations
+	ResultDenied = "denied"
+	// ResultErrored is recorded when the admission request could not be handled
+	ResultErrored = "errored"
+)
+
+const (
+	// FormatPEM labels injections of the PEM truststore
+	FormatPEM = "PEM"
+	// FormatJKS labels injections of the JKS truststore
+	FormatJKS = "JKS"
+	// FormatPKCS12 labels injections of the PKCS#12 truststore
+	FormatPKCS12 = "PKCS12"
+)
+
+var (
+	// AdmissionRequests counts the admission requests by result
+	AdmissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_requests_total",
+		Help:      "Number of admission requests handled, by result.",
+	}, []string{"result"})
+
+	// AdmissionDuration observes the time spent handling an admission request by result
+	AdmissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Time spent handling an admission request, by result.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"result"})
+
+	// ValidationRequests counts the validation requests by result
+	ValidationRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validation_requests_total",
+		Help:      "Number of validation requests handled, by result.",
+	}, []string{"result"})
+
+	// ValidationDuration observes the time spent handling a validation request by result
+	ValidationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "validation_duration_seconds",
+		Help:      "Time spent handling a validation request, by result.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"result"})
+
+	// Injections counts the truststores injected by format and namespace
+	Injections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "injections_total",
+		Help:      "Number of truststores injected into pods, by format and namespace.",
+	}, []string{"format", "namespace"})
+
+	// DecodeFailures counts the AdmissionReviews or Pods which could not be decoded
+	DecodeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_failures_total",
+		Help:      "Number of AdmissionReviews or Pods which could not be decoded.",
+	})
+
+	// PatchMarshalFailures counts the patches which could not be marshalled
+	PatchMarshalFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "patch_marshal_failures_total",
+		Help:      "Number of JSON patches which could not be marshalled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		AdmissionRequests,
+		AdmissionDuration,
+		ValidationRequests,
+		ValidationDuration,
+		Injections,
+		DecodeFailures,
+		PatchMarshalFailures,
+	)
+}
+
+// ObserveAdmission records the result and duration of an admission request started at start
+func ObserveAdmission(result string, start time.Time) {
+	AdmissionRequests.WithLabelValues(result).Inc()
+	AdmissionDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveValidation records the result and duration of a validation request started at start
+func ObserveValidation(result string, start time.Time) {
+	ValidationRequests.WithLabelValues(result).Inc()
+	ValidationDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
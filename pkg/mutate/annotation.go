@@ -1,9 +1,16 @@
 package mutate
 
 const (
+	// LabelInject opts the pod, or all the pods of the namespace, in to the injection with true, or out of it with false
+	// Unlike the annotations, it can be matched by the objectSelector and namespaceSelector of the webhooks
+	LabelInject = "custompki.openshift.io/inject"
+
 	// AnnotationCaPemInject controls the injection of the Custom CA Certificate in PEM format
 	AnnotationCaPemInject = "custompki.openshift.io/inject-pem"
 
+	// AnnotationProfile controls the distribution profile setting the base bundle, the PEM and JKS paths and their file names
+	AnnotationProfile = "custompki.openshift.io/profile"
+
 	// AnnotationCaPemInjectPath controls the path where the CaPem should be injected
 	AnnotationCaPemInjectPath = "custompki.openshift.io/inject-pem-path"
 
@@ -13,12 +20,91 @@ const (
 	// AnnotationCaJksInjectPath controls the path where the JKS Custom CA should be injected
 	AnnotationCaJksInjectPath = "custompki.openshift.io/inject-jks-path"
 
+	// AnnotationCaPkcs12Inject controls the injection of the Custom CA Certificate in PKCS#12 format
+	AnnotationCaPkcs12Inject = "custompki.openshift.io/inject-pkcs12"
+
+	// AnnotationCaPkcs12InjectPath controls the path where the PKCS#12 Custom CA should be injected
+	AnnotationCaPkcs12InjectPath = "custompki.openshift.io/inject-pkcs12-path"
+
+	// AnnotationMountMode controls if the truststores are mounted over their directory or as a single file
+	AnnotationMountMode = "custompki.openshift.io/mount-mode"
+
+	// AnnotationMountConflict controls if a truststore conflicting with a volume the container mounts at its path is skipped, replaces it or denies the pod
+	AnnotationMountConflict = "custompki.openshift.io/mount-conflict"
+
+	// AnnotationEmptyDirMedium controls the medium of the volumes the truststores are generated to, Memory for a tmpfs
+	AnnotationEmptyDirMedium = "custompki.openshift.io/emptydir-medium"
+
+	// AnnotationEmptyDirSizeLimit controls the size limit of the volumes the truststores are generated to
+	AnnotationEmptyDirSizeLimit = "custompki.openshift.io/emptydir-size-limit"
+
+	// AnnotationContainers controls the comma separated names of the only containers the CA is injected to
+	AnnotationContainers = "custompki.openshift.io/containers"
+
+	// AnnotationExcludeContainers controls the comma separated names of the containers the CA is not injected to
+	AnnotationExcludeContainers = "custompki.openshift.io/exclude-containers"
+
 	// AnnotationImage controls the image used for the init container
 	AnnotationImage = "custompki.openshift.io/image"
 
+	// AnnotationImagePullPolicy controls the image pull policy of the init containers
+	AnnotationImagePullPolicy = "custompki.openshift.io/image-pull-policy"
+
+	// AnnotationImagePullSecrets controls the comma separated names of the secrets added to the pod to pull the image of the init containers
+	AnnotationImagePullSecrets = "custompki.openshift.io/image-pull-secrets"
+
+	// AnnotationInitContainerPlacement controls where the init containers are inserted: first, last or before:<name>
+	AnnotationInitContainerPlacement = "custompki.openshift.io/init-container-placement"
+
+	// AnnotationRestrictedInitContainers controls if the init containers comply with the restricted pod security standard
+	AnnotationRestrictedInitContainers = "custompki.openshift.io/restricted-init-containers"
+
+	// AnnotationInitContainerCPURequest controls the CPU request of the init containers
+	AnnotationInitContainerCPURequest = "custompki.openshift.io/init-container-cpu-request"
+
+	// AnnotationInitContainerMemoryRequest controls the memory request of the init containers
+	AnnotationInitContainerMemoryRequest = "custompki.openshift.io/init-container-memory-request"
+
+	// AnnotationInitContainerCPULimit controls the CPU limit of the init containers
+	AnnotationInitContainerCPULimit = "custompki.openshift.io/init-container-cpu-limit"
+
+	// AnnotationInitContainerMemoryLimit controls the memory limit of the init containers
+	AnnotationInitContainerMemoryLimit = "custompki.openshift.io/init-container-memory-limit"
+
 	// AnnotationConfigMap controls the configmap containing merged CA
 	AnnotationConfigMap = "custompki.openshift.io/configmap"
 
+	// AnnotationNamePrefix controls the prefix of the names of the volumes and init containers added to the pod
+	AnnotationNamePrefix = "custompki.openshift.io/name-prefix"
+
+	// AnnotationInjectedNames records the names of the volumes and init containers added to the pod, by truststore format
+	// It is set by the injector
+	AnnotationInjectedNames = "custompki.openshift.io/injected-names"
+
+	// AnnotationPasswordSecret controls the secret containing the password of the JKS and PKCS#12 truststores
+	AnnotationPasswordSecret = "custompki.openshift.io/password-secret"
+
+	// AnnotationPasswordSecretKey controls the key of the password in the password secret
+	AnnotationPasswordSecretKey = "custompki.openshift.io/password-secret-key"
+
+	// AnnotationPasswordEnv controls the environment variable exposing the password to the containers
+	AnnotationPasswordEnv = "custompki.openshift.io/password-env"
+
+	// AnnotationInjectEnv controls the environment variables pointing the containers at the truststores
+	AnnotationInjectEnv = "custompki.openshift.io/inject-env"
+
 	// AnnotationRegexCn controls the regex matching the CAs to be added to merged CA
 	AnnotationRegexCn = "custompki.openshift.io/regex-cn"
+
+	// AnnotationRegexIssuer controls the regex the issuer of the CAs to be added to merged CA must match
+	AnnotationRegexIssuer = "custompki.openshift.io/regex-issuer"
+
+	// AnnotationRegexIssuerDeny controls the regex the issuer of the CAs to be added to merged CA must not match
+	AnnotationRegexIssuerDeny = "custompki.openshift.io/regex-issuer-deny"
+
+	// AnnotationFingerprintAllow controls the comma separated SHA-256 fingerprints of the only CAs to be added to merged CA
+	AnnotationFingerprintAllow = "custompki.openshift.io/fingerprint-allow"
+
+	// AnnotationFingerprintDeny controls the comma separated SHA-256 fingerprints of the CAs never added to merged CA
+	AnnotationFingerprintDeny = "custompki.openshift.io/fingerprint-deny"
 )
@@ -2,6 +2,39 @@ package mutate
 
 import log "github.com/sirupsen/logrus"
 
+// the placements of the init containers generating the truststores
+const (
+	// PlacementFirst inserts the init containers before the ones of the application, so that they get the truststores
+	PlacementFirst = "first"
+
+	// PlacementLast appends the init containers after the ones of the application
+	PlacementLast = "last"
+
+	// placementBefore prefixes the name of the init container of the application the init containers are inserted before
+	placementBefore = "before:"
+)
+
+// the mount modes of the truststores
+const (
+	// MountModeDirectory mounts the volume of a truststore over the directory of the injection path
+	MountModeDirectory = "directory"
+
+	// MountModeFile only mounts the file of a truststore in the injection path, keeping the other files of the directory
+	MountModeFile = "file"
+)
+
+// the policies resolving the conflict of a truststore with a volume a container already mounts at its path
+const (
+	// MountConflictSkip does not mount the truststore to the container
+	MountConflictSkip = "skip"
+
+	// MountConflictReplace mounts the truststore in place of the volume of the container
+	MountConflictReplace = "replace"
+
+	// MountConflictDeny rejects the pod
+	MountConflictDeny = "deny"
+)
+
 const (
 	// DefaultInjectPem defines
 	DefaultInjectPem = false
@@ -9,18 +42,66 @@ const (
 	// DefaultInjectPemPath defines
 	DefaultInjectPemPath = "/etc/pki/ca-trust/extracted/pem"
 
+	// DefaultInjectPemFile defines the default file name of the PEM truststore
+	DefaultInjectPemFile = "tls-ca-bundle.pem"
+
 	// DefaultInjectJks defines
 	DefaultInjectJks = false
 
 	// DefaultInjectJksPath defines
 	DefaultInjectJksPath = "/etc/pki/ca-trust/extracted/java"
 
-	// DefaultInitContainerImage defines default image for init container
-	DefaultInitContainerImage = "registry.redhat.io/ubi8/openjdk-11"
+	// DefaultInjectJksFile defines the default file name of the JKS truststore
+	DefaultInjectJksFile = "cacerts"
+
+	// DefaultInjectPkcs12 defines
+	DefaultInjectPkcs12 = false
+
+	// DefaultInjectPkcs12Path defines
+	DefaultInjectPkcs12Path = "/etc/pki/ca-trust/extracted/pkcs12"
+
+	// DefaultInjectPkcs12File defines the default file name of the PKCS#12 truststore
+	DefaultInjectPkcs12File = "truststore.p12"
+
+	// DefaultMountMode defines the default mount mode of the truststores
+	DefaultMountMode = MountModeDirectory
+
+	// DefaultMountConflict defines the default policy of the mount conflicts
+	DefaultMountConflict = MountConflictSkip
+
+	// DefaultBaseBundle defines the default bundle of the public CAs, as shipped in the injector image
+	DefaultBaseBundle = "/etc/ssl/certs/ca-certificates.crt"
+
+	// DefaultInitContainerImage defines default image for init container, i.e. the injector image
+	DefaultInitContainerImage = "quay.io/radudd/custom-ca-injector:latest"
+
+	// DefaultInitContainerPlacement defines the default placement of the init containers, before the ones of the application
+	DefaultInitContainerPlacement = PlacementFirst
+
+	// DefaultRestrictedInitContainers defines if the init containers comply with the restricted pod security standard by default
+	DefaultRestrictedInitContainers = true
+
+	// DefaultInitContainerCPURequest defines the default CPU request of the init containers
+	DefaultInitContainerCPURequest = "10m"
+
+	// DefaultInitContainerMemoryRequest defines the default memory request of the init containers
+	DefaultInitContainerMemoryRequest = "32Mi"
+
+	// DefaultInitContainerCPULimit defines the default CPU limit of the init containers
+	DefaultInitContainerCPULimit = "100m"
+
+	// DefaultInitContainerMemoryLimit defines the default memory limit of the init containers
+	DefaultInitContainerMemoryLimit = "64Mi"
 
 	// DefaultConfigMap defines the default name of the configMap containing custom CA
 	DefaultConfigMap = "custom-ca"
 
+	// DefaultNamePrefix defines the default prefix of the names of the volumes and init containers added to the pod
+	DefaultNamePrefix = "custom-ca"
+
+	// DefaultPasswordSecretKey defines the default key of the password in the password secret
+	DefaultPasswordSecretKey = "password"
+
 	// Default LogLevel
 	DefaultLogLevel = log.InfoLevel
 )
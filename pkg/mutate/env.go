@@ -0,0 +1,131 @@
+package mutate
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// the formats an environment variable can point at, given as NAME=format in the inject-env annotation
+const (
+	envFormatPem    = "pem"
+	envFormatPemDir = "pem-dir"
+	envFormatJks    = "jks"
+	envFormatPkcs12 = "pkcs12"
+)
+
+// javaPreset injects JAVA_TOOL_OPTIONS, which is built from the JKS or PKCS#12 truststore
+// javaPasswordPreset also sets the password of the truststore, read from the variable of password-env
+const (
+	javaPreset         = "java"
+	javaPasswordPreset = "java-password"
+)
+
+// envPreset is an environment variable of a preset and the format it points at
+type envPreset struct {
+	name   string
+	format string
+}
+
+// envPresets are the environment variables read by the runtimes to find their CAs
+var envPresets = map[string][]envPreset{
+	"node":   {{"NODE_EXTRA_CA_CERTS", envFormatPem}},
+	"python": {{"REQUESTS_CA_BUNDLE", envFormatPem}, {"SSL_CERT_FILE", envFormatPem}},
+	"go":     {{"SSL_CERT_FILE", envFormatPem}, {"SSL_CERT_DIR", envFormatPemDir}},
+}
+
+// validateEnvEntry checks an element of the inject-env list: a preset, NAME or NAME=format
+func validateEnvEntry(entry string) string {
+	if _, ok := envPresets[entry]; ok || entry == javaPreset || entry == javaPasswordPreset {
+		return ""
+	}
+	name, format := splitEnvEntry(entry)
+	if reason := validateEnvName(name); reason != "" {
+		return fmt.Sprintf("%q is neither a preset (go, java, java-password, node, python) nor a valid environment variable name: %s", entry, reason)
+	}
+	switch format {
+	case envFormatPem, envFormatPemDir, envFormatJks, envFormatPkcs12:
+		return ""
+	}
+	return fmt.Sprintf("%q must point at pem, pem-dir, jks or pkcs12", entry)
+}
+
+func validateEnvList(value string) string {
+	for _, entry := range SplitList(value) {
+		if reason := validateEnvEntry(entry); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// splitEnvEntry returns the name and the format of an explicit variable, the PEM bundle by default
+func splitEnvEntry(entry string) (string, string) {
+	if i := strings.Index(entry, "="); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return entry, envFormatPem
+}
+
+// truststoreLocation returns where the truststore of the format is mounted, empty if it is not injected
+func (s *Settings) truststoreLocation(format string) string {
+	if format == envFormatPemDir && s.InjectPem {
+		return s.InjectPemPath
+	}
+	for _, f := range truststoreFormats {
+		if inject, dir, file := f.location(s); f.name == format && inject {
+			return path.Join(dir, file)
+		}
+	}
+	return ""
+}
+
+// javaToolOptions returns the JVM options using the JKS truststore, or the PKCS#12 one if JKS is not injected
+// The password is left out unless withPassword is set: the JVM prints the options on startup, and reading trusted
+// certificates does not need it. It is then a reference to the variable of password-env, expanded by the kubelet,
+// so that the pod spec never holds it
+func (s *Settings) javaToolOptions(withPassword bool) string {
+	trustStore, trustStoreType := s.truststoreLocation(envFormatJks), "JKS"
+	if trustStore == "" {
+		trustStore, trustStoreType = s.truststoreLocation(envFormatPkcs12), "PKCS12"
+	}
+	if trustStore == "" {
+		return ""
+	}
+	options := fmt.Sprintf("-Djavax.net.ssl.trustStore=%s -Djavax.net.ssl.trustStoreType=%s", trustStore, trustStoreType)
+	if withPassword && s.PasswordSecret != "" && s.PasswordEnv != "" {
+		options += fmt.Sprintf(" -Djavax.net.ssl.trustStorePassword=$(%s)", s.PasswordEnv)
+	}
+	return options
+}
+
+// envVars returns the environment variables of InjectEnv pointing at the injected truststores
+// Variables pointing at a truststore which is not injected are left out, the first of several variables of the same name wins
+func (s *Settings) envVars() []corev1.EnvVar {
+	var env []corev1.EnvVar
+	defined := map[string]bool{}
+	add := func(name, value string) {
+		if value == "" || defined[name] {
+			return
+		}
+		defined[name] = true
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	for _, entry := range s.InjectEnv {
+		if entry == javaPreset || entry == javaPasswordPreset {
+			add("JAVA_TOOL_OPTIONS", s.javaToolOptions(entry == javaPasswordPreset))
+			continue
+		}
+		if preset, ok := envPresets[entry]; ok {
+			for _, v := range preset {
+				add(v.name, s.truststoreLocation(v.format))
+			}
+			continue
+		}
+		name, format := splitEnvEntry(entry)
+		add(name, s.truststoreLocation(format))
+	}
+	return env
+}
@@ -0,0 +1,65 @@
+package mutate
+
+import (
+	"strings"
+
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
+)
+
+// CertificateFilter selects the CAs of the configMap added to the merged CA
+// A CA is added if it matches all the configured allow rules and none of the deny rules
+type CertificateFilter struct {
+	// RegexCn must match the subject CN
+	RegexCn string `json:"regexCn,omitempty"`
+	// RegexIssuer must match the issuer DN
+	RegexIssuer string `json:"regexIssuer,omitempty"`
+	// RegexIssuerDeny must not match the issuer DN
+	RegexIssuerDeny string `json:"regexIssuerDeny,omitempty"`
+	// FingerprintAllow lists the SHA-256 fingerprints of the only CAs added
+	FingerprintAllow []string `json:"fingerprintAllow,omitempty"`
+	// FingerprintDeny lists the SHA-256 fingerprints of the CAs never added
+	FingerprintDeny []string `json:"fingerprintDeny,omitempty"`
+}
+
+// enabled reports if any rule is configured
+func (f CertificateFilter) enabled() bool {
+	return f.RegexCn != "" || f.RegexIssuer != "" || f.RegexIssuerDeny != "" ||
+		len(f.FingerprintAllow) > 0 || len(f.FingerprintDeny) > 0
+}
+
+// compile checks the rules, the filter itself is applied by the build-truststore command in the init containers
+func (f CertificateFilter) compile() (*truststore.Filter, error) {
+	return truststore.NewFilter(f.RegexCn, f.RegexIssuer, f.RegexIssuerDeny, f.FingerprintAllow, f.FingerprintDeny)
+}
+
+// args returns the arguments of the build-truststore command applying the filter
+func (f CertificateFilter) args() []string {
+	var args []string
+	if f.RegexCn != "" {
+		args = append(args, "-regex-cn", f.RegexCn)
+	}
+	if f.RegexIssuer != "" {
+		args = append(args, "-regex-issuer", f.RegexIssuer)
+	}
+	if f.RegexIssuerDeny != "" {
+		args = append(args, "-regex-issuer-deny", f.RegexIssuerDeny)
+	}
+	if len(f.FingerprintAllow) > 0 {
+		args = append(args, "-fingerprint-allow", strings.Join(f.FingerprintAllow, ","))
+	}
+	if len(f.FingerprintDeny) > 0 {
+		args = append(args, "-fingerprint-deny", strings.Join(f.FingerprintDeny, ","))
+	}
+	return args
+}
+
+// SplitList splits a comma separated annotation value or flag, ignoring empty elements
+func SplitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
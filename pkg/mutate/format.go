@@ -0,0 +1,92 @@
+package mutate
+
+import (
+	"path"
+
+	"github.com/radudd/custom-ca-inject/pkg/metrics"
+)
+
+// truststoreFormat describes how a truststore format is generated and injected
+type truststoreFormat struct {
+	// name is the format in the inject-env and injected-names annotations
+	name string
+	// label names the format in the metrics and the logs
+	label string
+	// flag is the option of build-truststore writing the format
+	flag string
+	// pathAnnotation and pathField override the directory the format is mounted to
+	pathAnnotation string
+	pathField      string
+	// protected is set if the truststore is protected by the password of the settings
+	protected bool
+	// location returns if the format is injected, the directory it is mounted to and its file in the directory
+	location func(s *Settings) (bool, string, string)
+}
+
+// truststoreFormats are the formats in the order they are injected
+var truststoreFormats = []truststoreFormat{
+	{
+		name:           envFormatJks,
+		label:          metrics.FormatJKS,
+		flag:           "-jks",
+		pathAnnotation: AnnotationCaJksInjectPath,
+		pathField:      "injectJksPath",
+		protected:      true,
+		location: func(s *Settings) (bool, string, string) {
+			return s.InjectJks, s.InjectJksPath, s.InjectJksFile
+		},
+	},
+	{
+		name:           envFormatPem,
+		label:          metrics.FormatPEM,
+		flag:           "-pem",
+		pathAnnotation: AnnotationCaPemInjectPath,
+		pathField:      "injectPemPath",
+		location: func(s *Settings) (bool, string, string) {
+			return s.InjectPem, s.InjectPemPath, s.InjectPemFile
+		},
+	},
+	{
+		name:           envFormatPkcs12,
+		label:          metrics.FormatPKCS12,
+		flag:           "-pkcs12",
+		pathAnnotation: AnnotationCaPkcs12InjectPath,
+		pathField:      "injectPkcs12Path",
+		protected:      true,
+		location: func(s *Settings) (bool, string, string) {
+			return s.InjectPkcs12, s.InjectPkcs12Path, s.InjectPkcs12File
+		},
+	},
+}
+
+// injected reports if the format is injected with the settings
+func (f truststoreFormat) injected(s *Settings) bool {
+	inject, _, _ := f.location(s)
+	return inject
+}
+
+// mountPath returns where the truststore of the format is mounted with the mount mode of the settings,
+// empty if the settings have no directory for the format
+func (f truststoreFormat) mountPath(s *Settings) string {
+	_, dir, file := f.location(s)
+	if dir == "" {
+		return ""
+	}
+	if s.MountMode == MountModeFile {
+		return path.Join(dir, file)
+	}
+	return path.Clean(dir)
+}
+
+// sharedMountPath returns two formats whose truststores would be mounted at the same path, whether injected or not,
+// ok is false if every format has its own path
+func (s *Settings) sharedMountPath() (first, second truststoreFormat, ok bool) {
+	for i, f := range truststoreFormats {
+		for _, g := range truststoreFormats[i+1:] {
+			if mountPath := f.mountPath(s); mountPath != "" && mountPath == g.mountPath(s) {
+				return f, g, true
+			}
+		}
+	}
+	return truststoreFormat{}, truststoreFormat{}, false
+}
@@ -0,0 +1,120 @@
+package mutate
+
+import (
+	"fmt"
+
+	"github.com/appscode/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// seccompProfile is the seccompProfile of a securityContext, added in Kubernetes 1.19 hence missing from the vendored API
+type seccompProfile struct {
+	Type string `json:"type"`
+}
+
+// seccompProfileRuntimeDefault is the seccomp profile of the container runtime required by the restricted pod security standard
+const seccompProfileRuntimeDefault = "RuntimeDefault"
+
+// initContainerSecurityContext returns the securityContext of the init containers generating the truststores,
+// none unless RestrictedInitContainers is set
+// They run as the user of the pod, so that the containers running as the same user own the truststores
+func (s *Settings) initContainerSecurityContext(pod *corev1.Pod) *corev1.SecurityContext {
+	if !s.RestrictedInitContainers {
+		return nil
+	}
+	uid := podRunAsUser(pod)
+	// a pod running as root cannot be restricted, runAsNonRoot would only prevent the init containers from starting
+	runAsNonRoot := uid == nil || *uid != 0
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	return &corev1.SecurityContext{
+		RunAsUser:                uid,
+		RunAsNonRoot:             &runAsNonRoot,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// initContainerResources returns the requests and limits of the init containers generating the truststores
+// The empty settings are not set
+func (s *Settings) initContainerResources() corev1.ResourceRequirements {
+	var resources corev1.ResourceRequirements
+	for _, r := range []struct {
+		list     *corev1.ResourceList
+		name     corev1.ResourceName
+		quantity string
+	}{
+		{&resources.Requests, corev1.ResourceCPU, s.InitContainerCPURequest},
+		{&resources.Requests, corev1.ResourceMemory, s.InitContainerMemoryRequest},
+		{&resources.Limits, corev1.ResourceCPU, s.InitContainerCPULimit},
+		{&resources.Limits, corev1.ResourceMemory, s.InitContainerMemoryLimit},
+	} {
+		// the quantities are validated with the settings and the annotations
+		quantity, err := resource.ParseQuantity(r.quantity)
+		if err != nil {
+			continue
+		}
+		if *r.list == nil {
+			*r.list = corev1.ResourceList{}
+		}
+		(*r.list)[r.name] = quantity
+	}
+	return resources
+}
+
+// resourceBound pairs the request and the limit of a resource of the init containers
+type resourceBound struct {
+	resource          corev1.ResourceName
+	request, limit    *string
+	requestField      string
+	limitField        string
+	requestAnnotation string
+	limitAnnotation   string
+}
+
+// initContainerResourceBounds returns the bounds of the resources of the init containers, pointing to the settings
+func (s *Settings) initContainerResourceBounds() []resourceBound {
+	return []resourceBound{
+		{corev1.ResourceCPU, &s.InitContainerCPURequest, &s.InitContainerCPULimit, "initContainerCpuRequest", "initContainerCpuLimit", AnnotationInitContainerCPURequest, AnnotationInitContainerCPULimit},
+		{corev1.ResourceMemory, &s.InitContainerMemoryRequest, &s.InitContainerMemoryLimit, "initContainerMemoryRequest", "initContainerMemoryLimit", AnnotationInitContainerMemoryRequest, AnnotationInitContainerMemoryLimit},
+	}
+}
+
+// exceeded reports if the request is above the limit, which the API server would reject
+// An unset or invalid quantity exceeds nothing
+func (b resourceBound) exceeded() bool {
+	request, err := resource.ParseQuantity(*b.request)
+	if err != nil {
+		return false
+	}
+	limit, err := resource.ParseQuantity(*b.limit)
+	if err != nil {
+		return false
+	}
+	return request.Cmp(limit) > 0
+}
+
+// addSeccompProfile returns the patch setting the RuntimeDefault seccomp profile of the init container at index,
+// whose securityContext is set
+func addSeccompProfile(index int) *jsonpatch.JsonPatchOperation {
+	return &jsonpatch.JsonPatchOperation{
+		Operation: "add",
+		Path:      fmt.Sprintf("/spec/initContainers/%d/securityContext/seccompProfile", index),
+		Value:     seccompProfile{Type: seccompProfileRuntimeDefault},
+	}
+}
+
+func validateQuantity(value string) string {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return fmt.Sprintf("must be a quantity, e.g. 100m or 64Mi: %v", err)
+	}
+	if quantity.Sign() <= 0 {
+		return "must be positive"
+	}
+	return ""
+}
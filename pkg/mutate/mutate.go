@@ -3,12 +3,15 @@ package mutate
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/appscode/jsonpatch"
+	"github.com/radudd/custom-ca-inject/pkg/metrics"
 	log "github.com/sirupsen/logrus"
-	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -20,91 +23,207 @@ var (
 	codecs = serializer.NewCodecFactory(scheme)
 )
 
-// based on annotations check if the pod requires mutations
-// returns a Pod object extracted from the Admission Review request if mutation is required
-// returns also an error object
-func requireMutation(body []byte) (*corev1.Pod, *admissionv1beta1.AdmissionReview, error) {
-	log.Debug(string(body))
+// toggleAnnotations are the annotations enabling a truststore format
+var toggleAnnotations = []string{AnnotationCaPemInject, AnnotationCaJksInject, AnnotationCaPkcs12Inject}
 
-	// Let's create the AdmissionReview and load the request body into
-	//arGVK := admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
+// optedOut reports if the pod is opted out of the injection by the inject label
+func optedOut(pod *corev1.Pod) bool {
+	return pod.ObjectMeta.Labels[LabelInject] == "false"
+}
 
-	var err error
-	ar := &admissionv1beta1.AdmissionReview{}
-	_, _, err = codecs.UniversalDeserializer().Decode(body, nil, ar)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Decoding failed with error: %v", err)
+// optedInByAnnotation reports if a format is enabled by an annotation of the pod or of one of its containers
+func optedInByAnnotation(annotations map[string]string) bool {
+	for key, value := range annotations {
+		annotation := key
+		if _, overridden, ok := splitContainerAnnotation(key); ok {
+			annotation = overridden
+		}
+		for _, toggle := range toggleAnnotations {
+			if annotation != toggle {
+				continue
+			}
+			if inject, err := strconv.ParseBool(value); err == nil && inject {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	// MutationWebhook is watching for Pods, hence when this is triggered
-	// K8S API sends a request with a Pod object to be mutated by the Webhook
-	// This Pod object is wrapped in the AdmissionReview.Request.Object.Raw
-
-	if ar.Request == nil {
-		return nil, nil, fmt.Errorf("AdmissionReview is empty")
+// requireMutation decides if the pod is injected and explains the decision
+// The inject label set to false opts out the pod, or all the pods of the namespace, which wins.
+// A pod opts in with the inject label set to true or an annotation enabling a format, and the namespace
+// opts in all its pods with the inject label set to true. Otherwise the pod gets the formats enabled by
+// the server defaults, unless an annotation of the pod disables them
+func requireMutation(pod *corev1.Pod, namespace map[string]string, defaults Settings) (bool, string) {
+	if optedOut(pod) {
+		return false, "opted out by the inject label"
 	}
-
-	pod := &corev1.Pod{}
-	_, _, err = codecs.UniversalDeserializer().Decode(ar.Request.Object.Raw, nil, pod)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to unmarshal json to a Pod object %v", err.Error())
+	if namespaceOptedOut(namespace) {
+		return false, "opted out by the inject label of the namespace"
+	}
+	if pod.ObjectMeta.Labels[LabelInject] == "true" {
+		return true, "opted in by the inject label"
 	}
-	if pod.ObjectMeta.Annotations[AnnotationCaPemInject] == "false" && pod.ObjectMeta.Annotations[AnnotationCaJksInject] == "false" {
-		return nil, nil, fmt.Errorf("Pod is not marked for Custom CA injection")
+	annotations := pod.ObjectMeta.Annotations
+	if optedInByAnnotation(annotations) {
+		return true, "opted in by annotation"
 	}
-	return pod, ar, nil
+	if namespaceOptedIn(namespace) {
+		return true, "opted in by the inject label of the namespace"
+	}
+	for _, toggle := range []struct {
+		annotation string
+		enabled    bool
+	}{
+		{AnnotationCaPemInject, defaults.InjectPem},
+		{AnnotationCaJksInject, defaults.InjectJks},
+		{AnnotationCaPkcs12Inject, defaults.InjectPkcs12},
+	} {
+		if _, set := annotations[toggle.annotation]; toggle.enabled && !set {
+			return true, "injected by the default settings"
+		}
+	}
+	return false, "not opted in"
 }
 
-func initialize(pod *corev1.Pod) (*injection, error) {
+// initialize resolves the effective settings of the pod from its annotations and the server defaults
+func initialize(pod *corev1.Pod, namespace map[string]string) (*Settings, error) {
+	in := currentSettings()
 
 	//install.Install(scheme)
-	in := injection{
-		injectPem: false,
-		injectJks: false,
-	}
-
-	// Check if any annotation present at all
-	if pod.ObjectMeta.Annotations == nil {
-		return &in, nil
-	}
+	annotations := pod.ObjectMeta.Annotations
 
 	// Check if annotation for injecting PEM ca is present
-	if extrInjectPem, ok := pod.ObjectMeta.Annotations[AnnotationCaPemInject]; ok {
+	if extrInjectPem, ok := annotations[AnnotationCaPemInject]; ok {
 		// Check annotation for injecting PEM is false
 		injectPem, err := strconv.ParseBool(extrInjectPem)
 		if err != nil {
-			return nil, err
+			return nil, &annotationError{AnnotationCaPemInject, extrInjectPem, "must be true or false"}
 		}
-		in.injectPem = injectPem
+		in.InjectPem = injectPem
 	}
 
 	// Check if annotation for injecting JKS ca is present
-	if extrInjectJks, ok := pod.ObjectMeta.Annotations[AnnotationCaJksInject]; ok {
+	if extrInjectJks, ok := annotations[AnnotationCaJksInject]; ok {
 		// Check annotation for injecting JKS is false
 		injectJks, err := strconv.ParseBool(extrInjectJks)
 		if err != nil {
-			return nil, err
+			return nil, &annotationError{AnnotationCaJksInject, extrInjectJks, "must be true or false"}
 		}
-		in.injectJks = injectJks
+		in.InjectJks = injectJks
 	}
-	if in.injectPem || in.injectJks {
-		if _, ok := pod.ObjectMeta.Annotations[AnnotationImage]; !ok {
-			pod.ObjectMeta.Annotations[AnnotationImage] = DefaultInitContainerImage
+	// Check if annotation for injecting PKCS#12 ca is present
+	if extrInjectPkcs12, ok := annotations[AnnotationCaPkcs12Inject]; ok {
+		injectPkcs12, err := strconv.ParseBool(extrInjectPkcs12)
+		if err != nil {
+			return nil, &annotationError{AnnotationCaPkcs12Inject, extrInjectPkcs12, "must be true or false"}
 		}
-		if _, ok := pod.ObjectMeta.Annotations[AnnotationConfigMap]; !ok {
-			pod.ObjectMeta.Annotations[AnnotationConfigMap] = DefaultConfigMap
+		in.InjectPkcs12 = injectPkcs12
+	}
+	// the inject label of the pod or of its namespace alone opts in to PEM
+	if (pod.ObjectMeta.Labels[LabelInject] == "true" || namespaceOptedIn(namespace)) && !in.InjectPem && !in.InjectJks && !in.InjectPkcs12 && !optedInByAnnotation(annotations) {
+		if _, set := annotations[AnnotationCaPemInject]; !set {
+			in.InjectPem = true
 		}
-		if _, ok := pod.ObjectMeta.Annotations[AnnotationCaPemInjectPath]; !ok {
-			pod.ObjectMeta.Annotations[AnnotationCaPemInjectPath] = DefaultInjectPemPath
+	}
+	if policy, ok := annotations[AnnotationMountConflict]; ok {
+		in.MountConflict = policy
+	}
+	if medium, ok := annotations[AnnotationEmptyDirMedium]; ok {
+		in.EmptyDirMedium = medium
+	}
+	if limit, ok := annotations[AnnotationEmptyDirSizeLimit]; ok {
+		in.EmptyDirSizeLimit = limit
+	}
+	if containers, ok := annotations[AnnotationContainers]; ok {
+		in.Containers = SplitList(containers)
+	}
+	if containers, ok := annotations[AnnotationExcludeContainers]; ok {
+		in.ExcludeContainers = SplitList(containers)
+	}
+	if image, ok := annotations[AnnotationImage]; ok {
+		in.InitContainerImage = image
+	}
+	if policy, ok := annotations[AnnotationImagePullPolicy]; ok {
+		in.ImagePullPolicy = policy
+	}
+	if secrets, ok := annotations[AnnotationImagePullSecrets]; ok {
+		in.ImagePullSecrets = SplitList(secrets)
+	}
+	if placement, ok := annotations[AnnotationInitContainerPlacement]; ok {
+		in.InitContainerPlacement = placement
+	}
+	if value, ok := annotations[AnnotationRestrictedInitContainers]; ok {
+		restricted, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, &annotationError{AnnotationRestrictedInitContainers, value, "must be true or false"}
 		}
-		if _, ok := pod.ObjectMeta.Annotations[AnnotationCaJksInjectPath]; !ok {
-			pod.ObjectMeta.Annotations[AnnotationCaJksInjectPath] = DefaultInjectJksPath
+		in.RestrictedInitContainers = restricted
+	}
+	for annotation, quantity := range map[string]*string{
+		AnnotationInitContainerCPURequest:    &in.InitContainerCPURequest,
+		AnnotationInitContainerMemoryRequest: &in.InitContainerMemoryRequest,
+		AnnotationInitContainerCPULimit:      &in.InitContainerCPULimit,
+		AnnotationInitContainerMemoryLimit:   &in.InitContainerMemoryLimit,
+	} {
+		if value, ok := annotations[annotation]; ok {
+			*quantity = value
 		}
 	}
+	if configMap, ok := annotations[AnnotationConfigMap]; ok {
+		in.ConfigMap = configMap
+	}
+	// the profile replaces the paths and the mount mode of the settings, the annotations override it
+	if profile, ok := annotations[AnnotationProfile]; ok {
+		in.Profile = profile
+	}
+	in.applyProfile()
+	if mode, ok := annotations[AnnotationMountMode]; ok {
+		in.MountMode = mode
+	}
+	if pemPath, ok := annotations[AnnotationCaPemInjectPath]; ok {
+		in.InjectPemPath = pemPath
+	}
+	if jksPath, ok := annotations[AnnotationCaJksInjectPath]; ok {
+		in.InjectJksPath = jksPath
+	}
+	if pkcs12Path, ok := annotations[AnnotationCaPkcs12InjectPath]; ok {
+		in.InjectPkcs12Path = pkcs12Path
+	}
+	if prefix, ok := annotations[AnnotationNamePrefix]; ok {
+		in.NamePrefix = prefix
+	}
+	if secret, ok := annotations[AnnotationPasswordSecret]; ok {
+		in.PasswordSecret = secret
+	}
+	if key, ok := annotations[AnnotationPasswordSecretKey]; ok {
+		in.PasswordSecretKey = key
+	}
+	if env, ok := annotations[AnnotationPasswordEnv]; ok {
+		in.PasswordEnv = env
+	}
+	if env, ok := annotations[AnnotationInjectEnv]; ok {
+		in.InjectEnv = SplitList(env)
+	}
+	if regexCn, ok := annotations[AnnotationRegexCn]; ok {
+		in.Filter.RegexCn = regexCn
+	}
+	if regexIssuer, ok := annotations[AnnotationRegexIssuer]; ok {
+		in.Filter.RegexIssuer = regexIssuer
+	}
+	if regexIssuerDeny, ok := annotations[AnnotationRegexIssuerDeny]; ok {
+		in.Filter.RegexIssuerDeny = regexIssuerDeny
+	}
+	if fingerprints, ok := annotations[AnnotationFingerprintAllow]; ok {
+		in.Filter.FingerprintAllow = SplitList(fingerprints)
+	}
+	if fingerprints, ok := annotations[AnnotationFingerprintDeny]; ok {
+		in.Filter.FingerprintDeny = SplitList(fingerprints)
+	}
 	return &in, nil
 }
 
-
 func getPodName(p *corev1.Pod) string {
 	if p.ObjectMeta.Name != "" {
 		return p.ObjectMeta.Name
@@ -113,55 +232,184 @@ func getPodName(p *corev1.Pod) string {
 }
 
 // Mutate defines how to mutate the request
+// Every decision on the pod is answered with an AdmissionReview, an error is only returned
+// if the body is not an AdmissionReview and there is no request to answer
 func Mutate(body []byte) ([]byte, error) {
-	// define patch operations
-	var patch []*jsonpatch.JsonPatchOperation
+	log.Debug(string(body))
 
-	var pod *corev1.Pod
-	var err error
-	var ar *admissionv1beta1.AdmissionReview
+	// record the outcome of the request, anything returning early is an error unless stated otherwise
+	start := time.Now()
+	result := metrics.ResultErrored
+	defer func() {
+		metrics.ObserveAdmission(result, start)
+	}()
 
-	if pod, ar, err = requireMutation(body); err != nil {
+	// Let's create the AdmissionReview and load the request body into
+	ar, err := decodeReview(body)
+	if err != nil {
+		metrics.DecodeFailures.Inc()
 		log.Error(err.Error())
 		return nil, err
 	}
+	if ar.request == nil {
+		log.Error("AdmissionReview is empty")
+		return nil, fmt.Errorf("AdmissionReview is empty")
+	}
 
-	// define the response that we will need to send back to K8S API
-	arResponse := admissionv1beta1.AdmissionResponse{}
+	d := admit(ar.request)
+	result = d.result
+	d.response.UID = ar.request.UID
 
-	in, err := initialize(pod)
+	// Wrap the Response in an AdmissionReview of the same version as the request
+	// and prepare the byte slice to be returned by the function
+	responseBody, err := ar.encode(d.response)
 	if err != nil {
-		log.Error(err.Error())
+		result = metrics.ResultErrored
+		return nil, err
+	}
+	// the injections are counted once the patch is sent to the K8S API
+	for _, format := range d.injections {
+		metrics.Injections.WithLabelValues(format, ar.request.Namespace).Inc()
+	}
+	return responseBody, nil
+}
+
+// admit decides on the pod of the request
+func admit(request *admissionv1.AdmissionRequest) *decision {
+	// define patch operations
+	var patch []*jsonpatch.JsonPatchOperation
+
+	// the containers and volumes of a pod are immutable, hence an UPDATE is never patched
+	if request.Operation == admissionv1.Update {
+		log.Debugf("Skipping the update of pod %s/%s", request.Namespace, request.Name)
+		return &decision{response: allowed(), result: metrics.ResultSkipped}
+	}
+
+	// MutationWebhook is watching for Pods, hence when this is triggered
+	// K8S API sends a request with a Pod object to be mutated by the Webhook
+	// This Pod object is wrapped in the AdmissionReview.Request.Object.Raw
+	pod := &corev1.Pod{}
+	if _, _, err := codecs.UniversalDeserializer().Decode(request.Object.Raw, nil, pod); err != nil {
+		metrics.DecodeFailures.Inc()
+		log.Errorf("Unable to unmarshal json to a Pod object %v", err)
+		return &decision{response: denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("Unable to decode the Pod: %v", err)), result: metrics.ResultErrored}
+	}
+
+	// the annotations of a pod opted out, or of the pods of a namespace opted out, are never read
+	if optedOut(pod) {
+		log.Debugf("Pod %s is opted out of Custom CA injection", getPodName(pod))
+		return &decision{response: allowed(), result: metrics.ResultSkipped}
+	}
+	namespace, err := currentNamespaceLabels()(request.Namespace)
+	if err != nil {
+		log.Errorf("Failed to read the labels of namespace %s: %v", request.Namespace, err)
+		return &decision{response: denied(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("Failed to read the labels of namespace %s: %v", request.Namespace, err)), result: metrics.ResultErrored}
+	}
+	if namespaceOptedOut(namespace) {
+		log.Debugf("Pod %s is opted out of Custom CA injection by namespace %s", getPodName(pod), request.Namespace)
+		return &decision{response: allowed(), result: metrics.ResultSkipped}
+	}
+
+	// reject malformed annotations here too, as the mutating webhook runs before the validating one
+	// and would otherwise produce a patch the API server rejects with an opaque error
+	if errs := validateAnnotations(pod); len(errs) > 0 {
+		log.Errorf("Rejecting pod %s with invalid annotations", getPodName(pod))
+		return &decision{response: invalidAnnotations(errs), result: metrics.ResultDenied}
 	}
 
-	if (*in).injectJks {
-		patch = append(patch, injectJksCA(pod)...)
-		log.Infof("Attempting mutation: injecting JKS to %s", getPodName(pod))
+	require, reason := requireMutation(pod, namespace, currentSettings())
+	if !require {
+		log.Debugf("Pod %s is not marked for Custom CA injection: %s", getPodName(pod), reason)
+		return &decision{response: allowed(), result: metrics.ResultSkipped}
 	}
-	if (*in).injectPem {
-		patch = append(patch, injectPemCA(pod)...)
-		log.Infof("Attempting mutation: injecting PEM to %s", getPodName(pod))
+	log.Debugf("Pod %s is marked for Custom CA injection: %s", getPodName(pod), reason)
+
+	in, err := initialize(pod, namespace)
+	if err != nil {
+		log.Errorf("Rejecting pod %s: %v", getPodName(pod), err)
+		return &decision{response: denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error()), result: metrics.ResultDenied}
+	}
+
+	// the names recorded by a previous injection are reused, e.g. when the webhook is reinvoked
+	n, err := recordedNames(pod)
+	if err != nil {
+		log.Errorf("Rejecting pod %s: %v", getPodName(pod), err)
+		return &decision{response: denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error()), result: metrics.ResultDenied}
+	}
+
+	ts, err := targets(pod, in, n.initContainers())
+	if err != nil {
+		log.Errorf("Rejecting pod %s: %v", getPodName(pod), err)
+		return &decision{response: denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error()), result: metrics.ResultDenied}
+	}
+
+	containers := map[string]*Settings{}
+	for _, t := range ts {
+		containers[t.container(pod).Name] = t.settings
 	}
 
-	// Create the AdmissionReview.Response
-	arResponse.Patch, err = json.Marshal(patch)
-	arResponse.Result = &metav1.Status{
-		Message: "Success",
-		Status:  metav1.StatusSuccess,
+	// a truststore is generated if it is injected to any of the selected containers
+	var initContainers []corev1.Container
+	var generators []generator
+	for _, f := range truststoreFormats {
+		if !anyTarget(ts, f.injected) {
+			continue
+		}
+		chosen := n.forFormat(pod, in.NamePrefix, f.name)
+		injection, generate, err := injectTruststore(pod, in, f, chosen, n.volumes(), ts)
+		if err != nil {
+			log.Errorf("Rejecting pod %s: %v", getPodName(pod), err)
+			return &decision{response: denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error()), result: metrics.ResultDenied, settings: in, containers: containers}
+		}
+		initContainers = append(initContainers, generate...)
+		generators = append(generators, generator{format: f.label, containers: generate})
+		if len(injection) > 0 {
+			patch = append(patch, injection...)
+			log.Infof("Attempting mutation: injecting %s to %s", f.label, getPodName(pod))
+		}
+	}
+	patch = append(patch, envToTargets(pod, ts)...)
+	// only the truststores generated by new init containers are counted, not the reinvocations of the webhook
+	injections := newInjections(pod, generators)
+	patch = append(patch, insertInitContainers(pod, in, initContainers)...)
+	if len(initContainers) > 0 {
+		patch = append(patch, addImagePullSecrets(&pod.Spec.ImagePullSecrets, in.ImagePullSecrets, "/spec/imagePullSecrets")...)
+	}
+	patch = append(patch, recordNames(pod, n)...)
+	if len(patch) == 0 {
+		return &decision{response: allowed(), result: metrics.ResultSkipped, settings: in, containers: containers}
 	}
-	arResponse.Allowed = true
-	arResponse.UID = ar.Request.UID
-	patchType := admissionv1beta1.PatchTypeJSONPatch
-	arResponse.PatchType = &patchType
 
-	// Populate AdmissionReview with the Response
-	ar.Response = &arResponse
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		metrics.PatchMarshalFailures.Inc()
+		log.Errorf("Failed to marshal the patch: %v", err)
+		return &decision{response: denied(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("Failed to marshal the patch: %v", err)), result: metrics.ResultErrored, settings: in, containers: containers}
+	}
+	return &decision{response: patched(patchBytes), result: metrics.ResultMutated, settings: in, containers: containers, injections: injections}
+}
 
-	// Prepare the byte slice to be returned by the function
-	responseBody, err := json.Marshal(ar)
+// DryRunResult is the outcome of a dry run
+type DryRunResult struct {
+	// Response is the answer Mutate would send to the K8S API
+	Response *admissionv1.AdmissionResponse
+	// Settings are the effective settings resolved for the pod, nil if the pod was not initialized
+	Settings *Settings
+	// Containers are the effective settings of the containers selected for the injection, by name
+	Containers map[string]*Settings
+}
 
+// DryRun runs the AdmissionReview through the same logic as Mutate and returns the outcome
+// instead of an encoded AdmissionReview
+func DryRun(body []byte) (*DryRunResult, error) {
+	ar, err := decodeReview(body)
 	if err != nil {
 		return nil, err
 	}
-	return responseBody, nil
-}
\ No newline at end of file
+	if ar.request == nil {
+		return nil, fmt.Errorf("AdmissionReview is empty")
+	}
+	d := admit(ar.request)
+	d.response.UID = ar.request.UID
+	return &DryRunResult{Response: d.response, Settings: d.settings, Containers: d.containers}, nil
+}
@@ -1,17 +1,108 @@
 package mutate
 
 import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
 	"testing"
 
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/radudd/custom-ca-inject/pkg/metrics"
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
 	"github.com/stretchr/testify/assert"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func TestMutatesValidRequest(t *testing.T) {
-	rawJSON := `{
+// testPod is the Pod object wrapped in the AdmissionReview fixtures
+const testPod = `{
+	"kind": "Pod",
+	"apiVersion": "v1",
+	"metadata": {
+		"name": "c7m",
+		"namespace": "yolo",
+		"creationTimestamp": null,
+		"labels": {
+			"name": "c7m"
+		},
+		"annotations": {
+			"custompki.openshift.io/inject-pem": "true"
+		}
+	},
+	"spec": {
+		"volumes": [
+			{
+				"name": "default-token-5z7xl",
+				"secret": {
+					"secretName": "default-token-5z7xl"
+				}
+			}
+		],
+		"containers": [
+			{
+				"name": "c7m",
+				"image": "centos:7",
+				"command": [
+					"/bin/bash"
+				],
+				"args": [
+					"-c",
+					"trap \"killall sleep\" TERM; trap \"kill -9 sleep\" KILL; sleep infinity"
+				],
+				"resources": {},
+				"volumeMounts": [
+					{
+						"name": "default-token-5z7xl",
+						"readOnly": true,
+						"mountPath": "/var/run/secrets/kubernetes.io/serviceaccount"
+					}
+				],
+				"terminationMessagePath": "/dev/termination-log",
+				"terminationMessagePolicy": "File",
+				"imagePullPolicy": "IfNotPresent"
+			}
+		],
+		"restartPolicy": "Always",
+		"terminationGracePeriodSeconds": 30,
+		"dnsPolicy": "ClusterFirst",
+		"serviceAccountName": "default",
+		"serviceAccount": "default",
+		"securityContext": {},
+		"schedulerName": "default-scheduler",
+		"tolerations": [
+			{
+				"key": "node.kubernetes.io/not-ready",
+				"operator": "Exists",
+				"effect": "NoExecute",
+				"tolerationSeconds": 300
+			},
+			{
+				"key": "node.kubernetes.io/unreachable",
+				"operator": "Exists",
+				"effect": "NoExecute",
+				"tolerationSeconds": 300
+			}
+		],
+		"priority": 0,
+		"enableServiceLinks": true
+	},
+	"status": {}
+}`
+
+// expectedPemPatch is the patch expected for testPod, annotated for PEM injection
+const expectedPemPatch = `[{"op":"add","path":"/spec/volumes/-","value":{"name":"custom-ca-pem","emptyDir":{}}},{"op":"add","path":"/spec/volumes/-","value":{"name":"custom-ca-pem-source","configMap":{"name":"custom-ca","items":[{"key":"ca-bundle.crt","path":"tls-ca-bundle.pem","mode":292}]}}},{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"name":"custom-ca-pem","readOnly":true,"mountPath":"/etc/pki/ca-trust/extracted/pem"}},{"op":"add","path":"/spec/initContainers","value":[{"name":"custom-ca-generate-pem","image":"quay.io/radudd/custom-ca-injector:latest","command":["/app/custom-ca-injector","build-truststore","-base","/etc/ssl/certs/ca-certificates.crt","-custom","/custom/tls-ca-bundle.pem","-mode","0444","-pem","/generated/tls-ca-bundle.pem"],"resources":{"limits":{"cpu":"100m","memory":"64Mi"},"requests":{"cpu":"10m","memory":"32Mi"}},"volumeMounts":[{"name":"custom-ca-pem","mountPath":"/generated"},{"name":"custom-ca-pem-source","mountPath":"/custom"}],"securityContext":{"capabilities":{"drop":["ALL"]},"runAsNonRoot":true,"readOnlyRootFilesystem":true,"allowPrivilegeEscalation":false}}]},{"op":"add","path":"/spec/initContainers/0/securityContext/seccompProfile","value":{"type":"RuntimeDefault"}},{"op":"add","path":"/metadata/annotations/custompki.openshift.io~1injected-names","value":"{\"pem\":{\"volume\":\"custom-ca-pem\",\"sourceVolume\":\"custom-ca-pem-source\",\"initContainer\":\"custom-ca-generate-pem\"}}"}]`
+
+// newTestReview wraps a Pod object in an AdmissionReview of the given apiVersion
+func newTestReview(apiVersion string, pod string) string {
+	return fmt.Sprintf(`{
 		"kind": "AdmissionReview",
-		"apiVersion": "admission.k8s.io/v1beta1",
+		"apiVersion": "%s",
 		"request": {
 			"uid": "7f0b2891-916f-4ed6-b7cd-27bff1815a8c",
 			"kind": {
@@ -43,79 +134,7 @@ func TestMutatesValidRequest(t *testing.T) {
 					"system:authenticated"
 				]
 			},
-			"object": {
-				"kind": "Pod",
-				"apiVersion": "v1",
-				"metadata": {
-					"name": "c7m",
-					"namespace": "yolo",
-					"creationTimestamp": null,
-					"labels": {
-						"name": "c7m"
-					},
-					"annotations": {
-						"custompki.openshift.io/inject-pem": "true"
-					}
-				},
-				"spec": {
-					"volumes": [
-						{
-							"name": "default-token-5z7xl",
-							"secret": {
-								"secretName": "default-token-5z7xl"
-							}
-						}
-					],
-					"containers": [
-						{
-							"name": "c7m",
-							"image": "centos:7",
-							"command": [
-								"/bin/bash"
-							],
-							"args": [
-								"-c",
-								"trap \"killall sleep\" TERM; trap \"kill -9 sleep\" KILL; sleep infinity"
-							],
-							"resources": {},
-							"volumeMounts": [
-								{
-									"name": "default-token-5z7xl",
-									"readOnly": true,
-									"mountPath": "/var/run/secrets/kubernetes.io/serviceaccount"
-								}
-							],
-							"terminationMessagePath": "/dev/termination-log",
-							"terminationMessagePolicy": "File",
-							"imagePullPolicy": "IfNotPresent"
-						}
-					],
-					"restartPolicy": "Always",
-					"terminationGracePeriodSeconds": 30,
-					"dnsPolicy": "ClusterFirst",
-					"serviceAccountName": "default",
-					"serviceAccount": "default",
-					"securityContext": {},
-					"schedulerName": "default-scheduler",
-					"tolerations": [
-						{
-							"key": "node.kubernetes.io/not-ready",
-							"operator": "Exists",
-							"effect": "NoExecute",
-							"tolerationSeconds": 300
-						},
-						{
-							"key": "node.kubernetes.io/unreachable",
-							"operator": "Exists",
-							"effect": "NoExecute",
-							"tolerationSeconds": 300
-						}
-					],
-					"priority": 0,
-					"enableServiceLinks": true
-				},
-				"status": {}
-			},
+			"object": %s,
 			"oldObject": null,
 			"dryRun": false,
 			"options": {
@@ -123,7 +142,11 @@ func TestMutatesValidRequest(t *testing.T) {
 				"apiVersion": "meta.k8s.io/v1"
 			}
 		}
-	}`
+	}`, apiVersion, pod)
+}
+
+func TestMutatesValidRequest(t *testing.T) {
+	rawJSON := newTestReview("admission.k8s.io/v1beta1", testPod)
 	response, err := Mutate([]byte(rawJSON))
 	if err != nil {
 		t.Errorf("failed to mutate AdmissionRequest %s with error %s", string(response), err)
@@ -136,8 +159,39 @@ func TestMutatesValidRequest(t *testing.T) {
 	r, _ := arObj.(*admissionv1beta1.AdmissionReview)
 	//assert.NoError(t, err, "conversion failed %s", err)
 
+	assert.Equal(t, "admission.k8s.io/v1beta1", r.APIVersion)
 	rr := r.Response
-	assert.Equal(t, `[{"op":"add","path":"/spec/volumes/-","value":{"name":"generated-pem","emptyDir":{}}},{"op":"add","path":"/spec/volumes/-","value":{"name":"custom-pem","configMap":{"name":"custom-ca","items":[{"key":"ca-bundle.crt","path":"tls-ca-bundle.pem","mode":256}]}}},{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"name":"generated-pem","readOnly":true,"mountPath":"/etc/pki/ca-trust/extracted/pem"}},{"op":"add","path":"/spec/initContainers","value":[{"name":"generate-pem-truststore","image":"registry.redhat.io/ubi8/openjdk-11","command":["sh","-xc","ls -ld /generated \u0026\u0026 cp /custom/tls-ca-bundle.pem /generated/custom.pem \u0026\u0026 cp /etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem /generated/base.pem \u0026\u0026 awk 'BEGIN {RS=\"-----END CERTIFICATE-----\"} {certs[$0] = $0 RS;} END {for(pem in certs) print certs[pem]}' /generated/*pem \u003e /generated/tls-ca-bundle.pem \u0026\u0026 rm /generated/custom.pem /generated/base.pem"],"resources":{},"volumeMounts":[{"name":"generated-pem","mountPath":"/generated"},{"name":"custom-pem","mountPath":"/custom"}]}]}]`, string(rr.Patch))
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+	assert.Equal(t, expectedPemPatch, string(rr.Patch))
+}
+
+func TestMutatesValidRequestV1(t *testing.T) {
+	rawJSON := newTestReview("admission.k8s.io/v1", testPod)
+	response, err := Mutate([]byte(rawJSON))
+	if err != nil {
+		t.Errorf("failed to mutate AdmissionRequest %s with error %s", string(response), err)
+	}
+
+	arGWK := admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	arObj, _, err := codecs.UniversalDeserializer().Decode(response, &arGWK, &admissionv1.AdmissionReview{})
+
+	assert.NoError(t, err, "decoding failed %s", err)
+	r, _ := arObj.(*admissionv1.AdmissionReview)
+
+	assert.Equal(t, "admission.k8s.io/v1", r.APIVersion)
+	assert.Equal(t, "AdmissionReview", r.Kind)
+	rr := r.Response
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+	assert.Equal(t, admissionv1.PatchTypeJSONPatch, *rr.PatchType)
+	assert.Equal(t, expectedPemPatch, string(rr.Patch))
+}
+
+func TestErrorsOnUnknownReviewVersion(t *testing.T) {
+	rawJSON := newTestReview("admission.k8s.io/v2", testPod)
+	_, err := Mutate([]byte(rawJSON))
+	if err == nil {
+		t.Error("did not fail when sending an unsupported AdmissionReview version")
+	}
 }
 
 func TestErrorsOnInvalidJson(t *testing.T) {
@@ -148,14 +202,1280 @@ func TestErrorsOnInvalidJson(t *testing.T) {
 	}
 }
 
-func TestErrorsOnInvalidPod(t *testing.T) {
+func TestDeniesInvalidPod(t *testing.T) {
 	rawJSON := `{
 		"request": {
+			"uid": "7f0b2891-916f-4ed6-b7cd-27bff1815a8c",
 			"object": 111
 		}
 	}`
-	_, err := Mutate([]byte(rawJSON))
-	if err == nil {
-		t.Error("did not fail when sending invalid pod")
+	rr := mutateTestReview(t, rawJSON)
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+	assert.Equal(t, int32(400), rr.Result.Code)
+}
+
+func TestAllowsPodNotMarkedForInjection(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject: "false",
+			AnnotationCaJksInject: "false",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+	assert.Empty(t, rr.Patch)
+	assert.Nil(t, rr.PatchType)
+}
+
+func TestDeniesInvalidToggleAnnotation(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaJksInject: "yes please",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+	assert.Equal(t, metav1.StatusReasonInvalid, rr.Result.Reason)
+	assert.Equal(t, `invalid value "yes please" for annotation custompki.openshift.io/inject-jks: must be true or false`, rr.Result.Message)
+}
+
+// newTestPod returns testPod after applying modify to it
+func newTestPod(t *testing.T, modify func(*corev1.Pod)) string {
+	pod := &corev1.Pod{}
+	assert.NoError(t, json.Unmarshal([]byte(testPod), pod))
+	modify(pod)
+	raw, err := json.Marshal(pod)
+	assert.NoError(t, err)
+	return string(raw)
+}
+
+// mutateTestReview sends the AdmissionReview to Mutate and returns the response as v1
+func mutateTestReview(t *testing.T, rawJSON string) *admissionv1.AdmissionResponse {
+	response, err := Mutate([]byte(rawJSON))
+	assert.NoError(t, err)
+	ar := &admissionv1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(response, ar))
+	assert.NotNil(t, ar.Response)
+	return ar.Response
+}
+
+// patchTestPod applies the JSON patch of a response to the pod and returns the patched pod
+func patchTestPod(t *testing.T, pod string, patch []byte) *corev1.Pod {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	assert.NoError(t, err)
+	raw, err := decoded.Apply([]byte(pod))
+	assert.NoError(t, err)
+	patched := &corev1.Pod{}
+	assert.NoError(t, json.Unmarshal(raw, patched))
+	return patched
+}
+
+// validateTestReview sends the AdmissionReview to Validate and returns the response as v1
+func validateTestReview(t *testing.T, rawJSON string) *admissionv1.AdmissionResponse {
+	response, err := Validate([]byte(rawJSON))
+	assert.NoError(t, err)
+	ar := &admissionv1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(response, ar))
+	assert.NotNil(t, ar.Response)
+	return ar.Response
+}
+
+func TestValidateAllowsValidAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject:     "true",
+			AnnotationCaPemInjectPath: "/etc/ssl/certs",
+			AnnotationCaJksInject:     "False",
+			AnnotationImage:           "registry.example.com:5000/ubi8/openjdk-11:1.3@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			AnnotationConfigMap:       "corporate-ca.v2",
+		}
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.Equal(t, "7f0b2891-916f-4ed6-b7cd-27bff1815a8c", string(rr.UID))
+}
+
+func TestValidateDeniesMalformedAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject:     "yes",
+			AnnotationCaJksInjectPath: "etc/pki/java",
+			AnnotationImage:           "Registry/UBI8:latest",
+			AnnotationConfigMap:       "Custom_CA",
+			AnnotationPasswordEnv:     "1PASSWORD",
+		}
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1beta1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, metav1.StatusReasonInvalid, rr.Result.Reason)
+	assert.Contains(t, rr.Result.Message, `invalid value "yes" for annotation custompki.openshift.io/inject-pem: must be true or false`)
+	assert.Contains(t, rr.Result.Message, `invalid value "etc/pki/java" for annotation custompki.openshift.io/inject-jks-path: must be an absolute path`)
+	assert.Contains(t, rr.Result.Message, `invalid value "Registry/UBI8:latest" for annotation custompki.openshift.io/image: must be a valid image reference`)
+	assert.Contains(t, rr.Result.Message, `invalid value "Custom_CA" for annotation custompki.openshift.io/configmap: a DNS-1123 subdomain`)
+	assert.Contains(t, rr.Result.Message, `invalid value "1PASSWORD" for annotation custompki.openshift.io/password-env: a valid environment variable name`)
+}
+
+func TestValidateAllowsUpdatesKeepingAnnotations(t *testing.T) {
+	old := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInject] = "yes"
+		pod.Finalizers = []string{"example.com/cleanup"}
+	})
+	update := func(pod string) string {
+		review := strings.Replace(newTestReview("admission.k8s.io/v1", pod), `"operation": "CREATE"`, `"operation": "UPDATE"`, 1)
+		return strings.Replace(review, `"oldObject": null`, `"oldObject": `+old, 1)
+	}
+
+	// removing the finalizer of a pod created before the validating webhook is not blocked by its annotations
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInject] = "yes"
+	})
+	rr := validateTestReview(t, update(pod))
+	assert.True(t, rr.Allowed)
+
+	// a changed annotation is validated
+	pod = newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInject] = "yes"
+		pod.Annotations[AnnotationCaPemInjectPath] = "etc/pki"
+	})
+	rr = validateTestReview(t, update(pod))
+	assert.False(t, rr.Allowed)
+	assert.Contains(t, rr.Result.Message, `invalid value "etc/pki" for annotation custompki.openshift.io/inject-pem-path: must be an absolute path`)
+}
+
+func TestMutateDeniesMalformedAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInjectPath] = "../pem"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Empty(t, rr.Patch)
+	assert.Equal(t, `invalid value "../pem" for annotation custompki.openshift.io/inject-pem-path: must be an absolute path`, rr.Result.Message)
+}
+
+func TestDryRunReturnsEffectiveSettings(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationConfigMap] = "corporate-ca"
+	})
+	result, err := DryRun([]byte(newTestReview("admission.k8s.io/v1", pod)))
+	assert.NoError(t, err)
+	assert.True(t, result.Response.Allowed)
+	assert.NotEmpty(t, result.Response.Patch)
+
+	expected := DefaultSettings()
+	expected.InjectPem = true
+	expected.ConfigMap = "corporate-ca"
+	assert.Equal(t, &expected, result.Settings)
+}
+
+func TestMutateFiltersCustomCAs(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationRegexCn] = "^Corp .* CA$"
+		pod.Annotations[AnnotationFingerprintDeny] = strings.Repeat("ab", 32)
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+
+	// both truststores are built from the same filtered CAs
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Len(t, patched.Spec.InitContainers, 2)
+	for _, c := range patched.Spec.InitContainers {
+		assert.Equal(t, []string{"-regex-cn", "^Corp .* CA$", "-fingerprint-deny", strings.Repeat("ab", 32)}, c.Command[len(c.Command)-4:], c.Name)
+	}
+}
+
+func TestMutatesPkcs12Request(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPkcs12Inject:     "true",
+			AnnotationCaPkcs12InjectPath: "/etc/truststore",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Len(t, patched.Spec.InitContainers, 1)
+	assert.Equal(t, "custom-ca-generate-pkcs12", patched.Spec.InitContainers[0].Name)
+	assert.Equal(t, []string{"/app/custom-ca-injector", "build-truststore", "-base", "/etc/ssl/certs/ca-certificates.crt", "-custom", "/custom/tls-ca-bundle.pem", "-mode", "0444", "-pkcs12", "/generated/truststore.p12"}, patched.Spec.InitContainers[0].Command)
+	assert.Contains(t, patched.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "custom-ca-pkcs12", MountPath: "/etc/truststore", ReadOnly: true})
+}
+
+func TestMutateNamesPkcs12File(t *testing.T) {
+	settings := DefaultSettings()
+	settings.InjectPkcs12File = "cacerts.p12"
+	Configure(settings)
+	defer Configure(DefaultSettings())
+
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPkcs12Inject: "true",
+			AnnotationMountMode:      MountModeFile,
+			AnnotationInjectEnv:      "TRUSTSTORE=pkcs12",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, []string{"-pkcs12", "/generated/cacerts.p12"}, patched.Spec.InitContainers[0].Command[8:])
+	assert.Equal(t, map[string]string{"custom-ca-pkcs12": "/etc/pki/ca-trust/extracted/pkcs12/cacerts.p12"}, mountsOf(patched.Spec.Containers[0]))
+	assert.Contains(t, patched.Spec.Containers[0].Env, corev1.EnvVar{Name: "TRUSTSTORE", Value: "/etc/pki/ca-trust/extracted/pkcs12/cacerts.p12"})
+}
+
+func TestMutatePasswordFromSecret(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaJksInject:       "true",
+			AnnotationCaPkcs12Inject:    "true",
+			AnnotationPasswordSecret:    "truststore",
+			AnnotationPasswordSecretKey: "storepass",
+			AnnotationPasswordEnv:       "JAVAX_NET_SSL_TRUSTSTOREPASSWORD",
+		}
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7", Env: []corev1.EnvVar{{Name: "JAVAX_NET_SSL_TRUSTSTOREPASSWORD", Value: "kept"}}}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.NotContains(t, string(rr.Patch), "-password")
+
+	secretRef := func(name string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "truststore"},
+			Key:                  "storepass",
+		}}}
+	}
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Len(t, patched.Spec.InitContainers, 3)
+	for _, c := range patched.Spec.InitContainers[:2] {
+		assert.Equal(t, []corev1.EnvVar{secretRef("TRUSTSTORE_PASSWORD")}, c.Env, c.Name)
+	}
+	assert.Equal(t, []corev1.EnvVar{secretRef("JAVAX_NET_SSL_TRUSTSTOREPASSWORD")}, patched.Spec.Containers[0].Env)
+	assert.Equal(t, []corev1.EnvVar{{Name: "JAVAX_NET_SSL_TRUSTSTOREPASSWORD", Value: "kept"}}, patched.Spec.InitContainers[2].Env)
+}
+
+func TestMutateDefaultPassword(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaJksInject: "true",
+			AnnotationPasswordEnv: "TRUSTSTORE_PASSWORD",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Empty(t, patched.Spec.InitContainers[0].Env)
+	assert.Empty(t, patched.Spec.Containers[0].Env)
+}
+
+func TestMutateInjectsRuntimeEnv(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject:    "true",
+			AnnotationCaJksInject:    "true",
+			AnnotationInjectEnv:      "node, python, java, CUSTOM_CA_DIR=pem-dir, P12=pkcs12",
+			AnnotationPasswordSecret: "truststore",
+		}
+		pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "NODE_EXTRA_CA_CERTS", Value: "/opt/ca.pem"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+
+	// the password is not exposed for JAVA_TOOL_OPTIONS, existing variables are kept and PKCS#12 is not injected
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "NODE_EXTRA_CA_CERTS", Value: "/opt/ca.pem"},
+		{Name: "REQUESTS_CA_BUNDLE", Value: "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"},
+		{Name: "SSL_CERT_FILE", Value: "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"},
+		{Name: "JAVA_TOOL_OPTIONS", Value: "-Djavax.net.ssl.trustStore=/etc/pki/ca-trust/extracted/java/cacerts -Djavax.net.ssl.trustStoreType=JKS"},
+		{Name: "CUSTOM_CA_DIR", Value: "/etc/pki/ca-trust/extracted/pem"},
+	}, patched.Spec.Containers[0].Env)
+}
+
+func TestMutateKeepsPasswordOutOfJavaToolOptions(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{},
+		{AnnotationPasswordSecret: "truststore"},
+		{AnnotationPasswordSecret: "truststore", AnnotationPasswordEnv: "TRUSTSTORE_PASSWORD"},
+		{AnnotationCaJksInject: "false", AnnotationCaPkcs12Inject: "true", AnnotationPasswordSecret: "truststore", AnnotationPasswordEnv: "STORE_PASS"},
+	} {
+		pod := newTestPod(t, func(pod *corev1.Pod) {
+			pod.Annotations[AnnotationCaJksInject] = "true"
+			pod.Annotations[AnnotationInjectEnv] = "java"
+			for key, value := range annotations {
+				pod.Annotations[key] = value
+			}
+		})
+		rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+		patched := patchTestPod(t, pod, rr.Patch)
+
+		// the JVM prints JAVA_TOOL_OPTIONS to the logs of the container
+		var options string
+		for _, e := range patched.Spec.Containers[0].Env {
+			if e.Name == "JAVA_TOOL_OPTIONS" {
+				options = e.Value
+				assert.Nil(t, e.ValueFrom)
+			}
+		}
+		assert.Contains(t, options, "-Djavax.net.ssl.trustStore=/etc/pki/ca-trust/extracted/")
+		for _, secret := range []string{"trustStorePassword", "$(", "TRUSTSTORE_PASSWORD", "STORE_PASS", truststore.DefaultPassword} {
+			assert.NotContains(t, options, secret, annotations)
+		}
+	}
+}
+
+func TestMutateSetsJavaTruststorePasswordFromSecret(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationInjectEnv] = "java-password"
+		pod.Annotations[AnnotationPasswordSecret] = "truststore"
+		pod.Annotations[AnnotationPasswordEnv] = "TRUSTSTORE_PASSWORD"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	// the kubelet expands the reference from the secretKeyRef variable, which has to come first
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "TRUSTSTORE_PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "truststore"}, Key: DefaultPasswordSecretKey}}},
+		{Name: "JAVA_TOOL_OPTIONS", Value: "-Djavax.net.ssl.trustStore=/etc/pki/ca-trust/extracted/java/cacerts -Djavax.net.ssl.trustStoreType=JKS -Djavax.net.ssl.trustStorePassword=$(TRUSTSTORE_PASSWORD)"},
+	}, patched.Spec.Containers[0].Env)
+}
+
+func TestValidateDeniesJavaPasswordWithoutSecret(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		message     string
+	}{
+		{"no secret", map[string]string{AnnotationInjectEnv: "java-password", AnnotationPasswordEnv: "TRUSTSTORE_PASSWORD"}, `invalid value "java-password" for annotation custompki.openshift.io/inject-env: the java-password preset needs the custompki.openshift.io/password-secret and custompki.openshift.io/password-env annotations`},
+		{"no variable", map[string]string{containerAnnotation("c7m", AnnotationInjectEnv): "node,java-password", AnnotationPasswordSecret: "truststore"}, `invalid value "node,java-password" for annotation c7m.custompki.openshift.io/inject-env: the java-password preset needs the custompki.openshift.io/password-secret and custompki.openshift.io/password-env annotations`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Annotations[AnnotationCaJksInject] = "true"
+				for k, v := range tc.annotations {
+					pod.Annotations[k] = v
+				}
+			})
+			rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			assert.False(t, rr.Allowed)
+			assert.Equal(t, tc.message, rr.Result.Message)
+		})
+	}
+}
+
+func TestValidateDeniesUnknownEnvPreset(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationInjectEnv] = "node,CA=der"
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, `invalid value "node,CA=der" for annotation custompki.openshift.io/inject-env: "CA=der" must point at pem, pem-dir, jks or pkcs12`, rr.Result.Message)
+}
+
+// mountsOf returns the mount paths of the volumes of the container by volume name, leaving out the volumes of the test pod
+func mountsOf(c corev1.Container) map[string]string {
+	mounts := map[string]string{}
+	for _, m := range c.VolumeMounts {
+		if m.Name != "default-token-5z7xl" {
+			mounts[m.Name] = m.MountPath
+		}
+	}
+	return mounts
+}
+
+func TestMutateTargetsContainers(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject:                                            "true",
+			AnnotationExcludeContainers:                                      "istio-proxy",
+			containerAnnotation("app", AnnotationCaJksInject):                "true",
+			containerAnnotation("app", AnnotationCaPemInject):                "false",
+			containerAnnotation("log-shipper", AnnotationCaPemInjectPath):    "/etc/ssl/certs",
+			containerAnnotation("log-shipper", AnnotationInjectEnv):          "go",
+			containerAnnotation("not-in-the-pod-yet", AnnotationCaJksInject): "true",
+		}
+		app := pod.Spec.Containers[0]
+		app.Name = "app"
+		pod.Spec.Containers = []corev1.Container{app, {Name: "log-shipper", Image: "fluentbit"}, {Name: "istio-proxy", Image: "proxyv2"}}
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, map[string]string{"custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}, mountsOf(patched.Spec.Containers[0]))
+	assert.Empty(t, patched.Spec.Containers[0].Env)
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/ssl/certs"}, mountsOf(patched.Spec.Containers[1]))
+	assert.Equal(t, []corev1.EnvVar{{Name: "SSL_CERT_FILE", Value: "/etc/ssl/certs/tls-ca-bundle.pem"}, {Name: "SSL_CERT_DIR", Value: "/etc/ssl/certs"}}, patched.Spec.Containers[1].Env)
+	assert.Empty(t, mountsOf(patched.Spec.Containers[2]))
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem"}, mountsOf(patched.Spec.InitContainers[2]))
+	assert.Len(t, patched.Spec.InitContainers, 3)
+}
+
+func TestMutateIncludesOnlyListedContainers(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationContainers] = "c7m"
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "centos:7"})
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem"}, mountsOf(patched.Spec.Containers[0]))
+	assert.Empty(t, mountsOf(patched.Spec.Containers[1]))
+	assert.Empty(t, mountsOf(patched.Spec.InitContainers[1]))
+}
+
+func TestMutateSkipsPodWithoutSelectedContainers(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationExcludeContainers] = "c7m"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.Empty(t, rr.Patch)
+}
+
+func TestValidateDeniesMalformedContainerAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationExcludeContainers] = "istio-proxy,Sidecar"
+		pod.Annotations[containerAnnotation("app", AnnotationCaJksInject)] = "yes"
+		pod.Annotations[containerAnnotation("App_1", AnnotationCaPemInjectPath)] = "/etc/ssl"
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Contains(t, rr.Result.Message, `invalid value "istio-proxy,Sidecar" for annotation custompki.openshift.io/exclude-containers: "Sidecar" is not a valid container name`)
+	assert.Contains(t, rr.Result.Message, `invalid value "yes" for annotation app.custompki.openshift.io/inject-jks: must be true or false`)
+	assert.Contains(t, rr.Result.Message, `invalid value "/etc/ssl" for annotation App_1.custompki.openshift.io/inject-pem-path: "App_1" is not a valid container name`)
+}
+
+func TestMutateIsIdempotent(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = map[string]string{
+			AnnotationCaPemInject: "true",
+			AnnotationCaJksInject: "true",
+			AnnotationInjectEnv:   "node",
+		}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched, err := json.Marshal(patchTestPod(t, pod, rr.Patch))
+	assert.NoError(t, err)
+
+	// a reinvocation with the patched pod changes nothing
+	rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(patched)))
+	assert.True(t, rr.Allowed)
+	assert.Empty(t, rr.Patch)
+}
+
+func TestMutateReinvocationInjectsAddedContainers(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationInjectEnv] = "node"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	// another webhook adds a sidecar, the reinvocation only injects it
+	patched.Spec.Containers = append(patched.Spec.Containers, corev1.Container{Name: "sidecar", Image: "centos:7"})
+	reinvoked, err := json.Marshal(patched)
+	assert.NoError(t, err)
+	rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(reinvoked)))
+	assert.JSONEq(t, `[
+		{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"name":"custom-ca-pem","readOnly":true,"mountPath":"/etc/pki/ca-trust/extracted/pem"}]},
+		{"op":"add","path":"/spec/containers/1/env","value":[{"name":"NODE_EXTRA_CA_CERTS","value":"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}]}
+	]`, string(rr.Patch))
+}
+
+func TestMutateSkipsUpdate(t *testing.T) {
+	review := strings.Replace(newTestReview("admission.k8s.io/v1", testPod), `"operation": "CREATE"`, `"operation": "UPDATE"`, 1)
+	rr := mutateTestReview(t, review)
+	assert.True(t, rr.Allowed)
+	assert.Empty(t, rr.Patch)
+}
+
+func TestValidateDeniesMalformedFilterAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationRegexCn] = "Corp ("
+		pod.Annotations[AnnotationFingerprintAllow] = "ab:cd"
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Contains(t, rr.Result.Message, `invalid value "Corp (" for annotation custompki.openshift.io/regex-cn: must be a valid regular expression`)
+	assert.Contains(t, rr.Result.Message, `invalid value "ab:cd" for annotation custompki.openshift.io/fingerprint-allow: must be a comma separated list of SHA-256 fingerprints`)
+}
+
+func TestMutateSuffixesTakenNames(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationNamePrefix] = "pki"
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "pki-pem", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+		pod.Spec.InitContainers = []corev1.Container{{Name: "pki-generate-pem", Image: "centos:7"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.JSONEq(t, `{
+		"jks": {"volume": "pki-jks", "sourceVolume": "pki-jks-source", "initContainer": "pki-generate-jks"},
+		"pem": {"volume": "pki-pem-2", "sourceVolume": "pki-pem-source", "initContainer": "pki-generate-pem-2"}
+	}`, patched.Annotations[AnnotationInjectedNames])
+	assert.Equal(t, map[string]string{"pki-pem-2": "/etc/pki/ca-trust/extracted/pem", "pki-jks": "/etc/pki/ca-trust/extracted/java"}, mountsOf(patched.Spec.Containers[0]))
+	// the init container of the application keeps its name and gets the truststores
+	assert.Equal(t, "pki-generate-pem", patched.Spec.InitContainers[2].Name)
+	assert.Equal(t, map[string]string{"pki-pem-2": "/etc/pki/ca-trust/extracted/pem", "pki-jks": "/etc/pki/ca-trust/extracted/java"}, mountsOf(patched.Spec.InitContainers[2]))
+	assert.Len(t, patched.Spec.InitContainers, 3)
+
+	// a reinvocation finds the recorded names
+	reinvoked, err := json.Marshal(patched)
+	assert.NoError(t, err)
+	rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(reinvoked)))
+	assert.Empty(t, rr.Patch)
+}
+
+func TestMutateRecordsNamesInPodWithoutAnnotations(t *testing.T) {
+	Configure(Settings{InjectPem: true, InjectPemPath: DefaultInjectPemPath, InitContainerImage: DefaultInitContainerImage, ConfigMap: DefaultConfigMap, NamePrefix: DefaultNamePrefix})
+	defer Configure(DefaultSettings())
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations = nil
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.JSONEq(t, `{"pem": {"volume": "custom-ca-pem", "sourceVolume": "custom-ca-pem-source", "initContainer": "custom-ca-generate-pem"}}`, patched.Annotations[AnnotationInjectedNames])
+}
+
+func TestValidateDeniesMalformedNameAnnotations(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationNamePrefix] = "Custom_CA"
+		pod.Annotations[AnnotationInjectedNames] = `{"der": {"volume": "custom-ca-der", "sourceVolume": "custom-ca-der-source", "initContainer": "custom-ca-generate-der"}}`
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Contains(t, rr.Result.Message, `invalid value "Custom_CA" for annotation custompki.openshift.io/name-prefix: a DNS-1123 label must consist of`)
+	assert.Contains(t, rr.Result.Message, `for annotation custompki.openshift.io/injected-names: "der" is not a truststore format, one of pem, jks or pkcs12`)
+}
+
+func TestMutateDecisionTable(t *testing.T) {
+	injectPemByDefault := DefaultSettings()
+	injectPemByDefault.InjectPem = true
+
+	for _, tc := range []struct {
+		name        string
+		defaults    Settings
+		namespace   map[string]string
+		labels      map[string]string
+		annotations map[string]string
+		// denied is true if the pod is rejected
+		denied bool
+		// formats are the formats injected, none if the pod is allowed unchanged
+		formats []string
+	}{
+		{name: "no opt-in", defaults: DefaultSettings()},
+		{name: "default formats", defaults: injectPemByDefault, formats: []string{"pem"}},
+		{name: "default format disabled by annotation", defaults: injectPemByDefault, annotations: map[string]string{AnnotationCaPemInject: "false"}},
+		{name: "annotation opt-in", defaults: DefaultSettings(), annotations: map[string]string{AnnotationCaJksInject: "true"}, formats: []string{"jks"}},
+		{name: "annotation opt-in next to default formats", defaults: injectPemByDefault, annotations: map[string]string{AnnotationCaPkcs12Inject: "true"}, formats: []string{"pem", "pkcs12"}},
+		{name: "container annotation opt-in", defaults: DefaultSettings(), annotations: map[string]string{containerAnnotation("c7m", AnnotationCaJksInject): "true"}, formats: []string{"jks"}},
+		{name: "all formats disabled", defaults: DefaultSettings(), annotations: map[string]string{AnnotationCaPemInject: "false", AnnotationCaJksInject: "false", AnnotationCaPkcs12Inject: "false"}},
+		{name: "label opt-in", defaults: DefaultSettings(), labels: map[string]string{LabelInject: "true"}, formats: []string{"pem"}},
+		{name: "label opt-in with annotation", defaults: DefaultSettings(), labels: map[string]string{LabelInject: "true"}, annotations: map[string]string{AnnotationCaJksInject: "true"}, formats: []string{"jks"}},
+		{name: "label opt-in with PEM disabled", defaults: DefaultSettings(), labels: map[string]string{LabelInject: "true"}, annotations: map[string]string{AnnotationCaPemInject: "false"}},
+		{name: "label opt-out", defaults: injectPemByDefault, labels: map[string]string{LabelInject: "false"}, annotations: map[string]string{AnnotationCaJksInject: "true"}},
+		{name: "label opt-out with invalid annotation", defaults: DefaultSettings(), labels: map[string]string{LabelInject: "false"}, annotations: map[string]string{AnnotationCaJksInject: "yes"}},
+		{name: "invalid annotation", defaults: DefaultSettings(), annotations: map[string]string{AnnotationCaJksInject: "yes"}, denied: true},
+		{name: "invalid label", defaults: DefaultSettings(), labels: map[string]string{LabelInject: "yes"}, denied: true},
+		{name: "namespace opt-in", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "true"}, formats: []string{"pem"}},
+		{name: "namespace opt-in with annotation", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "true"}, annotations: map[string]string{AnnotationCaJksInject: "true"}, formats: []string{"jks"}},
+		{name: "namespace opt-in with default formats", defaults: injectPemByDefault, namespace: map[string]string{LabelInject: "true"}, annotations: map[string]string{AnnotationCaPkcs12Inject: "true"}, formats: []string{"pem", "pkcs12"}},
+		{name: "namespace opt-in with PEM disabled", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "true"}, annotations: map[string]string{AnnotationCaPemInject: "false"}},
+		{name: "namespace opt-in with label opt-out", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "true"}, labels: map[string]string{LabelInject: "false"}},
+		{name: "namespace opt-out", defaults: injectPemByDefault, namespace: map[string]string{LabelInject: "false"}},
+		{name: "namespace opt-out with label opt-in", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "false"}, labels: map[string]string{LabelInject: "true"}},
+		{name: "namespace opt-out with annotation opt-in", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "false"}, annotations: map[string]string{AnnotationCaJksInject: "true"}},
+		{name: "namespace opt-out with invalid annotation", defaults: DefaultSettings(), namespace: map[string]string{LabelInject: "false"}, annotations: map[string]string{AnnotationCaJksInject: "yes"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			Configure(tc.defaults)
+			defer Configure(DefaultSettings())
+			ConfigureNamespaceLabels(func(name string) (map[string]string, error) {
+				assert.Equal(t, "yolo", name)
+				return tc.namespace, nil
+			})
+			defer ConfigureNamespaceLabels(func(string) (map[string]string, error) { return nil, nil })
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Labels = tc.labels
+				pod.Annotations = tc.annotations
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			assert.Equal(t, !tc.denied, rr.Allowed)
+			if len(tc.formats) == 0 {
+				assert.Empty(t, rr.Patch)
+				return
+			}
+			recorded := injectedNames{}
+			assert.NoError(t, json.Unmarshal([]byte(patchTestPod(t, pod, rr.Patch).Annotations[AnnotationInjectedNames]), &recorded))
+			var formats []string
+			for format := range recorded {
+				formats = append(formats, format)
+			}
+			assert.ElementsMatch(t, tc.formats, formats)
+		})
+	}
+}
+
+func TestMutateDeniesWhenNamespaceLabelsCannotBeRead(t *testing.T) {
+	ConfigureNamespaceLabels(func(string) (map[string]string, error) { return nil, fmt.Errorf("connection refused") })
+	defer ConfigureNamespaceLabels(func(string) (map[string]string, error) { return nil, nil })
+
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", testPod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, "Failed to read the labels of namespace yolo: connection refused", rr.Result.Message)
+}
+
+func TestMutateAppliesProfile(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationProfile] = "debian"
+		pod.Annotations[AnnotationInjectEnv] = "go"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	c := patched.Spec.Containers[0]
+	// only the truststore files are mounted, the other files of /etc/ssl/certs are kept
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/ssl/certs/ca-certificates.crt", "custom-ca-jks": "/etc/ssl/certs/java/cacerts"}, mountsOf(c))
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-pem", MountPath: "/etc/ssl/certs/ca-certificates.crt", SubPath: "ca-certificates.crt", ReadOnly: true})
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-jks", MountPath: "/etc/ssl/certs/java/cacerts", SubPath: "cacerts", ReadOnly: true})
+	assert.Equal(t, []corev1.EnvVar{{Name: "SSL_CERT_FILE", Value: "/etc/ssl/certs/ca-certificates.crt"}, {Name: "SSL_CERT_DIR", Value: "/etc/ssl/certs"}}, c.Env)
+	// the public CAs are the ones of the injector image, whatever the profile
+	for _, init := range patched.Spec.InitContainers {
+		assert.Equal(t, []string{"-base", DefaultBaseBundle}, init.Command[2:4], init.Name)
+	}
+	assert.Equal(t, []string{"-pem", "/generated/ca-certificates.crt"}, patched.Spec.InitContainers[1].Command[8:])
+}
+
+func TestMutateProfileOverridesBaseBundle(t *testing.T) {
+	s := DefaultSettings()
+	s.InitContainerImage = "registry.example.com/custom-ca-injector-alpine:latest"
+	s.ProfileBaseBundles = map[string]string{"alpine": "/etc/ssl/cert.pem", "distroless": ""}
+	Configure(s)
+	defer Configure(DefaultSettings())
+	for profile, expected := range map[string]string{
+		"alpine":     "/etc/ssl/cert.pem",
+		"distroless": "",
+		"debian":     DefaultBaseBundle,
+	} {
+		pod := newTestPod(t, func(pod *corev1.Pod) {
+			pod.Annotations[AnnotationProfile] = profile
+		})
+		rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+		patched := patchTestPod(t, pod, rr.Patch)
+		assert.Equal(t, []string{"-base", expected}, patched.Spec.InitContainers[0].Command[2:4], profile)
+	}
+}
+
+func TestMutateProfileKeepsSiblingFiles(t *testing.T) {
+	for _, name := range []string{"debian", "alpine", "distroless"} {
+		pod := newTestPod(t, func(pod *corev1.Pod) {
+			pod.Annotations[AnnotationCaJksInject] = "true"
+			pod.Annotations[AnnotationProfile] = name
+		})
+		rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+		patched := patchTestPod(t, pod, rr.Patch)
+
+		// no volume hides the hash links and the other bundles of the image
+		for _, m := range patched.Spec.Containers[0].VolumeMounts {
+			assert.NotEqual(t, "/etc/ssl/certs", path.Clean(m.MountPath), name)
+			assert.NotEqual(t, "/etc/ssl/certs/java", path.Clean(m.MountPath), name)
+			if strings.HasPrefix(m.Name, "custom-ca-") {
+				assert.NotEmpty(t, m.SubPath, name)
+			}
+		}
+	}
+}
+
+func TestMutateMountModeAnnotationOverridesProfile(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationProfile] = "debian"
+		pod.Annotations[AnnotationMountMode] = MountModeDirectory
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	c := patchTestPod(t, pod, rr.Patch).Spec.Containers[0]
+
+	// the JKS mount point is created in the PEM volume, which cannot be read-only
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-pem", MountPath: "/etc/ssl/certs"})
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-jks", MountPath: "/etc/ssl/certs/java", ReadOnly: true})
+}
+
+func TestMutatePathAnnotationsOverrideProfile(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationProfile] = "rhel"
+		pod.Annotations[AnnotationCaJksInjectPath] = "/opt/java/cacerts.d"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem", "custom-ca-jks": "/opt/java/cacerts.d"}, mountsOf(patched.Spec.Containers[0]))
+	assert.Equal(t, []string{"-base", DefaultBaseBundle}, patched.Spec.InitContainers[0].Command[2:4])
+}
+
+func TestValidateDeniesUnknownProfile(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationProfile] = "ubuntu"
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, `invalid value "ubuntu" for annotation custompki.openshift.io/profile: must be one of alpine, debian, distroless, rhel`, rr.Result.Message)
+}
+
+func TestMutatePlacesInitContainers(t *testing.T) {
+	for _, tc := range []struct {
+		placement string
+		expected  []string
+	}{
+		{"", []string{"custom-ca-generate-jks", "custom-ca-generate-pem", "migrate", "warmup"}},
+		{PlacementFirst, []string{"custom-ca-generate-jks", "custom-ca-generate-pem", "migrate", "warmup"}},
+		{PlacementLast, []string{"migrate", "warmup", "custom-ca-generate-jks", "custom-ca-generate-pem"}},
+		{"before:warmup", []string{"migrate", "custom-ca-generate-jks", "custom-ca-generate-pem", "warmup"}},
+	} {
+		t.Run(tc.placement, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Annotations[AnnotationCaJksInject] = "true"
+				if tc.placement != "" {
+					pod.Annotations[AnnotationInitContainerPlacement] = tc.placement
+				}
+				pod.Annotations[AnnotationInjectEnv] = "node"
+				pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7"}, {Name: "warmup", Image: "centos:7"}}
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			patched := patchTestPod(t, pod, rr.Patch)
+
+			var names []string
+			generated := false
+			for _, c := range patched.Spec.InitContainers {
+				names = append(names, c.Name)
+				if strings.HasPrefix(c.Name, "custom-ca-generate-") {
+					generated = true
+					continue
+				}
+				// the init containers of the application only get the truststores once they are generated
+				if generated {
+					assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem", "custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}, mountsOf(c), c.Name)
+					assert.Equal(t, []corev1.EnvVar{{Name: "NODE_EXTRA_CA_CERTS", Value: "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}}, c.Env, c.Name)
+				} else {
+					assert.Empty(t, mountsOf(c), c.Name)
+					assert.Empty(t, c.Env, c.Name)
+				}
+			}
+			assert.Equal(t, tc.expected, names)
+
+			// a reinvocation with an init container added by another webhook only injects it
+			patched.Spec.InitContainers = append(patched.Spec.InitContainers, corev1.Container{Name: "vault-agent-init", Image: "vault"})
+			reinvoked, err := json.Marshal(patched)
+			assert.NoError(t, err)
+			rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(reinvoked)))
+			assert.NotContains(t, string(rr.Patch), "custom-ca-generate")
+			assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem", "custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}, mountsOf(patchTestPod(t, string(reinvoked), rr.Patch).Spec.InitContainers[4]))
+		})
+	}
+}
+
+func TestValidateDeniesInvalidPlacement(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		annotation string
+		setting    string
+		message    string
+	}{
+		{"malformed", "after:migrate", PlacementFirst, `invalid value "after:migrate" for annotation custompki.openshift.io/init-container-placement: must be first, last or before:<name> of an init container`},
+		{"missing init container", "before:not-in-the-pod", PlacementFirst, `invalid value "before:not-in-the-pod" for annotation custompki.openshift.io/init-container-placement: init container not-in-the-pod is not in the pod`},
+		{"missing init container of the settings", "", "before:not-in-the-pod", `init container not-in-the-pod of the initContainerPlacement setting "before:not-in-the-pod" is not in the pod`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := DefaultSettings()
+			s.InitContainerPlacement = tc.setting
+			Configure(s)
+			defer Configure(DefaultSettings())
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				if tc.annotation != "" {
+					pod.Annotations[AnnotationInitContainerPlacement] = tc.annotation
+				}
+				pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7"}}
+			})
+			for _, rr := range []*admissionv1.AdmissionResponse{
+				validateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+				mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+			} {
+				assert.False(t, rr.Allowed)
+				assert.Equal(t, tc.message, rr.Result.Message)
+			}
+		})
+	}
+}
+
+func TestMutateMountsFiles(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationProfile] = "debian"
+		pod.Annotations[AnnotationMountMode] = MountModeFile
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	// the files are mounted read-only as they do not nest any mount point
+	c := patched.Spec.Containers[0]
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-pem", MountPath: "/etc/ssl/certs/ca-certificates.crt", SubPath: "ca-certificates.crt", ReadOnly: true})
+	assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "custom-ca-jks", MountPath: "/etc/ssl/certs/java/cacerts", SubPath: "cacerts", ReadOnly: true})
+}
+
+func TestMutateSkipsConflictingMounts(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationMountMode] = MountModeFile
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "bundle", MountPath: "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", SubPath: "ca.pem"})
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "centos:7"})
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+	assert.Equal(t, map[string]string{"bundle": "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}, mountsOf(patched.Spec.Containers[0]))
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}, mountsOf(patched.Spec.Containers[1]))
+}
+
+func TestMutateDoesNotInjectBeforeGeneration(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationInitContainerPlacement] = "before:warmup"
+		pod.Annotations[containerAnnotation("migrate", AnnotationMountMode)] = MountModeFile
+		pod.Annotations[containerAnnotation("warmup", AnnotationMountMode)] = MountModeFile
+		pod.Annotations[AnnotationInjectEnv] = "node"
+		pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "centos:7"}, {Name: "migrate", Image: "centos:7"}, {Name: "warmup", Image: "centos:7"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	assert.Equal(t, "custom-ca-generate-pem", patched.Spec.InitContainers[2].Name)
+	// neither an empty directory nor a missing file is injected, whatever the mount mode
+	for _, c := range patched.Spec.InitContainers[:2] {
+		assert.Empty(t, mountsOf(c), c.Name)
+		assert.Empty(t, c.Env, c.Name)
+	}
+	assert.Equal(t, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}, mountsOf(patched.Spec.InitContainers[3]))
+}
+
+func TestMutateResolvesMountConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		// mounts are the mounts of the container, nil if the pod is denied
+		mounts map[string]string
+	}{
+		{"skip by default", nil, map[string]string{"team-ca": "/etc/pki/ca-trust/extracted/pem/", "custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}},
+		{"replace", map[string]string{AnnotationMountConflict: MountConflictReplace}, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem", "custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}},
+		{"deny", map[string]string{AnnotationMountConflict: MountConflictDeny}, nil},
+		{"replace for the container", map[string]string{AnnotationMountConflict: MountConflictDeny, containerAnnotation("c7m", AnnotationMountConflict): MountConflictReplace}, map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem", "custom-ca-jks": "/etc/pki/ca-trust/extracted/java"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Annotations[AnnotationCaJksInject] = "true"
+				for k, v := range tc.annotations {
+					pod.Annotations[k] = v
+				}
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "team-ca", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "team-ca"}}}})
+				pod.Spec.Containers[0].VolumeMounts = append([]corev1.VolumeMount{{Name: "team-ca", MountPath: "/etc/pki/ca-trust/extracted/pem/"}}, pod.Spec.Containers[0].VolumeMounts...)
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			if tc.mounts == nil {
+				assert.False(t, rr.Allowed)
+				assert.Equal(t, "container c7m already mounts volume team-ca at /etc/pki/ca-trust/extracted/pem, where the truststore volume custom-ca-pem is mounted: set the custompki.openshift.io/mount-conflict annotation to skip or replace to resolve the conflict", rr.Result.Message)
+				return
+			}
+			assert.True(t, rr.Allowed)
+			c := patchTestPod(t, pod, rr.Patch).Spec.Containers[0]
+			assert.Equal(t, tc.mounts, mountsOf(c))
+			// the other mounts of the container are kept
+			assert.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "default-token-5z7xl", ReadOnly: true, MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"})
+		})
+	}
+}
+
+func TestMutateResolvesNestedMountConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		mountPath   string
+		// mounts are the mounts of the container, nil if the pod is denied
+		mounts  map[string]string
+		message string
+	}{
+		{"directory above the file", map[string]string{AnnotationMountMode: MountModeFile}, "/etc/pki/ca-trust/extracted/pem", map[string]string{"team-ca": "/etc/pki/ca-trust/extracted/pem"}, ""},
+		{"directory below the directory", nil, "/etc/pki/ca-trust/extracted/pem/team", map[string]string{"team-ca": "/etc/pki/ca-trust/extracted/pem/team"}, ""},
+		{"replace", map[string]string{AnnotationMountMode: MountModeFile, AnnotationMountConflict: MountConflictReplace}, "/etc/pki/ca-trust/extracted/pem", map[string]string{"custom-ca-pem": "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"}, ""},
+		{"deny", map[string]string{AnnotationMountMode: MountModeFile, AnnotationMountConflict: MountConflictDeny}, "/etc/pki/ca-trust/extracted/pem", nil,
+			"container c7m already mounts volume team-ca at /etc/pki/ca-trust/extracted/pem, overlapping /etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem where the truststore volume custom-ca-pem is mounted: set the custompki.openshift.io/mount-conflict annotation to skip or replace to resolve the conflict"},
+		{"sibling directory", nil, "/etc/pki/ca-trust/extracted/pem-team", map[string]string{"team-ca": "/etc/pki/ca-trust/extracted/pem-team", "custom-ca-pem": "/etc/pki/ca-trust/extracted/pem"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				for k, v := range tc.annotations {
+					pod.Annotations[k] = v
+				}
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "team-ca", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "team-ca"}}}})
+				pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "team-ca", MountPath: tc.mountPath, ReadOnly: true})
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			if tc.mounts == nil {
+				assert.False(t, rr.Allowed)
+				assert.Equal(t, tc.message, rr.Result.Message)
+				return
+			}
+			assert.True(t, rr.Allowed)
+			assert.Equal(t, tc.mounts, mountsOf(patchTestPod(t, pod, rr.Patch).Spec.Containers[0]))
+		})
+	}
+}
+
+func TestValidateDeniesSharedInjectPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		// message is the denial, empty if the pod is allowed
+		message string
+	}{
+		{"JKS in the PEM directory", map[string]string{AnnotationCaJksInjectPath: "/etc/pki/ca-trust/extracted/pem/"}, `invalid value "/etc/pki/ca-trust/extracted/pem/" for annotation custompki.openshift.io/inject-jks-path: must not mount the JKS truststore at /etc/pki/ca-trust/extracted/pem, where the PEM truststore is mounted`},
+		{"PEM in the PKCS#12 directory", map[string]string{AnnotationCaPemInjectPath: "/etc/pki/ca-trust/extracted/pkcs12"}, `invalid value "/etc/pki/ca-trust/extracted/pkcs12" for annotation custompki.openshift.io/inject-pem-path: must not mount the PEM truststore at /etc/pki/ca-trust/extracted/pkcs12, where the PKCS12 truststore is mounted`},
+		{"other files of the directory", map[string]string{AnnotationMountMode: MountModeFile, AnnotationCaJksInjectPath: "/etc/pki/ca-trust/extracted/pem"}, ""},
+		{"directories swapped in the file mount mode", map[string]string{AnnotationProfile: "debian", AnnotationCaJksInjectPath: "/etc/ssl/certs", containerAnnotation("c7m", AnnotationCaPemInjectPath): "/etc/ssl/certs/java"}, ""},
+		{"container", map[string]string{containerAnnotation("c7m", AnnotationCaPkcs12InjectPath): "/etc/pki/ca-trust/extracted/java"}, `invalid value "/etc/pki/ca-trust/extracted/java" for annotation c7m.custompki.openshift.io/inject-pkcs12-path: must not mount the PKCS12 truststore at /etc/pki/ca-trust/extracted/java, where the JKS truststore is mounted`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				for k, v := range tc.annotations {
+					pod.Annotations[k] = v
+				}
+			})
+			for _, rr := range []*admissionv1.AdmissionResponse{
+				validateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+				mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+			} {
+				if tc.message == "" {
+					assert.True(t, rr.Allowed)
+					continue
+				}
+				assert.False(t, rr.Allowed)
+				assert.Equal(t, tc.message, rr.Result.Message)
+			}
+		})
+	}
+}
+
+func TestMutateSetsTruststorePermissions(t *testing.T) {
+	uid, otherUID, root, group := int64(1000680000), int64(1001), int64(0), int64(1000680000)
+	for _, tc := range []struct {
+		name      string
+		pod       *corev1.PodSecurityContext
+		container *corev1.SecurityContext
+		output    string
+		source    int32
+	}{
+		{"no security context", nil, nil, "0444", 0444},
+		{"fsGroup", &corev1.PodSecurityContext{FSGroup: &group}, nil, "0440", 0440},
+		{"same user", &corev1.PodSecurityContext{RunAsUser: &uid, FSGroup: &group}, nil, "0400", 0440},
+		{"other user with fsGroup", &corev1.PodSecurityContext{RunAsUser: &uid, FSGroup: &group}, &corev1.SecurityContext{RunAsUser: &otherUID}, "0440", 0440},
+		{"other user", &corev1.PodSecurityContext{RunAsUser: &uid}, &corev1.SecurityContext{RunAsUser: &otherUID}, "0444", 0444},
+		{"root", &corev1.PodSecurityContext{RunAsUser: &root}, nil, "0400", 0400},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext = tc.pod
+				pod.Spec.Containers[0].SecurityContext = tc.container
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			patched := patchTestPod(t, pod, rr.Patch)
+
+			assert.Equal(t, []string{"-mode", tc.output}, patched.Spec.InitContainers[0].Command[6:8])
+			for _, v := range patched.Spec.Volumes {
+				if v.Name == "custom-ca-pem-source" {
+					assert.Equal(t, tc.source, *v.ConfigMap.Items[0].Mode)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateConfiguresEmptyDir(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationEmptyDirMedium] = "Memory"
+		pod.Annotations[AnnotationEmptyDirSizeLimit] = "10Mi"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	for _, v := range patched.Spec.Volumes {
+		if v.Name == "custom-ca-pem" || v.Name == "custom-ca-jks" {
+			assert.Equal(t, corev1.StorageMediumMemory, v.EmptyDir.Medium, v.Name)
+			assert.Equal(t, "10Mi", v.EmptyDir.SizeLimit.String(), v.Name)
+		}
+	}
+}
+
+func TestValidateDeniesInvalidEmptyDir(t *testing.T) {
+	for annotation, tc := range map[string]struct {
+		value   string
+		message string
+	}{
+		AnnotationEmptyDirMedium:    {"HugePages", `invalid value "HugePages" for annotation custompki.openshift.io/emptydir-medium: must be empty for the storage of the node or Memory`},
+		AnnotationEmptyDirSizeLimit: {"-1Mi", `invalid value "-1Mi" for annotation custompki.openshift.io/emptydir-size-limit: must be positive`},
+	} {
+		pod := newTestPod(t, func(pod *corev1.Pod) {
+			pod.Annotations[annotation] = tc.value
+		})
+		rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+		assert.False(t, rr.Allowed, annotation)
+		assert.Equal(t, tc.message, rr.Result.Message, annotation)
+	}
+}
+
+func TestMutateRestrictsInitContainers(t *testing.T) {
+	uid := int64(1000680000)
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationInitContainerPlacement] = "before:warmup"
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &uid}
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "centos:7"}, {Name: "warmup", Image: "centos:7"}}
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	patched := patchTestPod(t, pod, rr.Patch)
+
+	runAsNonRoot, allowPrivilegeEscalation, readOnlyRootFilesystem := true, false, true
+	for _, c := range patched.Spec.InitContainers[1:3] {
+		assert.Equal(t, &corev1.SecurityContext{
+			RunAsUser:                &uid,
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		}, c.SecurityContext, c.Name)
+		assert.Equal(t, "10m", c.Resources.Requests.Cpu().String(), c.Name)
+		assert.Equal(t, "64Mi", c.Resources.Limits.Memory().String(), c.Name)
+	}
+	assert.Nil(t, patched.Spec.InitContainers[0].SecurityContext)
+
+	// the seccomp profile is missing from the vendored API, hence checked in the patch
+	assert.Contains(t, string(rr.Patch), `{"op":"add","path":"/spec/initContainers/1/securityContext/seccompProfile","value":{"type":"RuntimeDefault"}}`)
+	assert.Contains(t, string(rr.Patch), `{"op":"add","path":"/spec/initContainers/2/securityContext/seccompProfile","value":{"type":"RuntimeDefault"}}`)
+	assert.NotContains(t, string(rr.Patch), "/spec/initContainers/0/securityContext")
+	assert.NotContains(t, string(rr.Patch), "/spec/initContainers/3/securityContext")
+}
+
+func TestMutateConfiguresInitContainers(t *testing.T) {
+	root := int64(0)
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		pod         *corev1.PodSecurityContext
+		check       func(t *testing.T, c corev1.Container, patch string)
+	}{
+		{"root", nil, &corev1.PodSecurityContext{RunAsUser: &root}, func(t *testing.T, c corev1.Container, patch string) {
+			assert.Equal(t, &root, c.SecurityContext.RunAsUser)
+			assert.False(t, *c.SecurityContext.RunAsNonRoot)
+		}},
+		{"unrestricted", map[string]string{AnnotationRestrictedInitContainers: "false"}, nil, func(t *testing.T, c corev1.Container, patch string) {
+			assert.Nil(t, c.SecurityContext)
+			assert.NotContains(t, patch, "seccompProfile")
+		}},
+		{"resources", map[string]string{AnnotationInitContainerCPURequest: "50m", AnnotationInitContainerMemoryRequest: "64Mi", AnnotationInitContainerCPULimit: "", AnnotationInitContainerMemoryLimit: "128Mi"}, nil, func(t *testing.T, c corev1.Container, patch string) {
+			assert.Equal(t, "50m", c.Resources.Requests.Cpu().String())
+			assert.Equal(t, "64Mi", c.Resources.Requests.Memory().String())
+			assert.Equal(t, corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}, c.Resources.Limits)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				for key, value := range tc.annotations {
+					pod.Annotations[key] = value
+				}
+				pod.Spec.SecurityContext = tc.pod
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			tc.check(t, patchTestPod(t, pod, rr.Patch).Spec.InitContainers[0], string(rr.Patch))
+		})
 	}
 }
+
+func TestValidateDeniesInvalidResources(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationInitContainerMemoryLimit] = "lots"
+	})
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, `invalid value "lots" for annotation custompki.openshift.io/init-container-memory-limit: must be a quantity, e.g. 100m or 64Mi: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'`, rr.Result.Message)
+}
+
+func TestValidateDeniesRequestsAboveLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		// message is the denial, empty if the pod is allowed
+		message string
+	}{
+		{"limit below the default request", map[string]string{AnnotationInitContainerMemoryLimit: "16Mi"}, `invalid value "16Mi" for annotation custompki.openshift.io/init-container-memory-limit: must not be below the memory request 32Mi`},
+		{"request above the default limit", map[string]string{AnnotationInitContainerCPURequest: "200m"}, `invalid value "200m" for annotation custompki.openshift.io/init-container-cpu-request: must not exceed the cpu limit 100m`},
+		{"request above the limit", map[string]string{AnnotationInitContainerCPURequest: "1", AnnotationInitContainerCPULimit: "500m"}, `invalid value "500m" for annotation custompki.openshift.io/init-container-cpu-limit: must not be below the cpu request 1`},
+		{"request equal to the limit", map[string]string{AnnotationInitContainerMemoryRequest: "64Mi", AnnotationInitContainerMemoryLimit: "0.0625Gi"}, ""},
+		{"unset limit", map[string]string{AnnotationInitContainerCPURequest: "200m", AnnotationInitContainerCPULimit: ""}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				for k, v := range tc.annotations {
+					pod.Annotations[k] = v
+				}
+			})
+			for _, rr := range []*admissionv1.AdmissionResponse{
+				validateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+				mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod)),
+			} {
+				if tc.message == "" {
+					assert.True(t, rr.Allowed)
+					continue
+				}
+				assert.False(t, rr.Allowed)
+				assert.Equal(t, tc.message, rr.Result.Message)
+			}
+		})
+	}
+}
+
+func TestMutateAddsImagePullSecrets(t *testing.T) {
+	for name, existing := range map[string][]corev1.LocalObjectReference{
+		"without pull secrets": nil,
+		"with pull secrets":    {{Name: "team-registry"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pod := newTestPod(t, func(pod *corev1.Pod) {
+				pod.Annotations[AnnotationCaJksInject] = "true"
+				pod.Annotations[AnnotationImage] = "registry.example.com/mirror/custom-ca-injector:latest"
+				pod.Annotations[AnnotationImagePullPolicy] = "Always"
+				pod.Annotations[AnnotationImagePullSecrets] = "mirror-pull, team-registry, mirror-pull"
+				pod.Spec.ImagePullSecrets = existing
+			})
+			rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+			patched := patchTestPod(t, pod, rr.Patch)
+
+			expected := []corev1.LocalObjectReference{{Name: "mirror-pull"}, {Name: "team-registry"}}
+			if existing != nil {
+				expected = []corev1.LocalObjectReference{{Name: "team-registry"}, {Name: "mirror-pull"}}
+			}
+			assert.Equal(t, expected, patched.Spec.ImagePullSecrets)
+			for _, c := range patched.Spec.InitContainers {
+				assert.Equal(t, corev1.PullAlways, c.ImagePullPolicy, c.Name)
+			}
+
+			// a reinvocation does not add them twice
+			reinvoked, err := json.Marshal(patched)
+			assert.NoError(t, err)
+			rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(reinvoked)))
+			assert.NotContains(t, string(rr.Patch), "imagePullSecrets")
+		})
+	}
+}
+
+func TestMutateLeavesImagePullSecretsWithoutInitContainers(t *testing.T) {
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInject] = "false"
+		pod.Annotations[AnnotationImagePullSecrets] = "mirror-pull"
+	})
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.Empty(t, rr.Patch)
+}
+
+func TestValidateDeniesInvalidImagePullSettings(t *testing.T) {
+	for annotation, tc := range map[string]struct {
+		value   string
+		message string
+	}{
+		AnnotationImagePullPolicy:  {"Sometimes", `invalid value "Sometimes" for annotation custompki.openshift.io/image-pull-policy: must be Always, IfNotPresent or Never`},
+		AnnotationImagePullSecrets: {"mirror-pull,Team_Registry", `invalid value "mirror-pull,Team_Registry" for annotation custompki.openshift.io/image-pull-secrets: "Team_Registry" is not a valid secret name: a DNS-1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`},
+	} {
+		pod := newTestPod(t, func(pod *corev1.Pod) {
+			pod.Annotations[annotation] = tc.value
+		})
+		rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+		assert.False(t, rr.Allowed, annotation)
+		assert.Equal(t, tc.message, rr.Result.Message, annotation)
+	}
+}
+
+func TestMutateRecordsMetrics(t *testing.T) {
+	injections := func(format string) float64 {
+		return testutil.ToFloat64(metrics.Injections.WithLabelValues(format, "yolo"))
+	}
+	requests := func(result string) float64 {
+		return testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues(result))
+	}
+
+	// an allowed pod counts the truststores it is injected
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+	})
+	pem, jks, mutated := injections(metrics.FormatPEM), injections(metrics.FormatJKS), requests(metrics.ResultMutated)
+	rr := mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.True(t, rr.Allowed)
+	assert.Equal(t, pem+1, injections(metrics.FormatPEM))
+	assert.Equal(t, jks+1, injections(metrics.FormatJKS))
+	assert.Equal(t, mutated+1, requests(metrics.ResultMutated))
+
+	// a reinvocation adding no init container counts no injection, even when it injects a new container
+	patched := patchTestPod(t, pod, rr.Patch)
+	patched.Spec.Containers = append(patched.Spec.Containers, corev1.Container{Name: "sidecar", Image: "centos:7"})
+	reinvoked, err := json.Marshal(patched)
+	assert.NoError(t, err)
+	pem, jks, mutated = injections(metrics.FormatPEM), injections(metrics.FormatJKS), requests(metrics.ResultMutated)
+	rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", string(reinvoked)))
+	assert.True(t, rr.Allowed)
+	assert.NotEmpty(t, rr.Patch)
+	assert.Equal(t, pem, injections(metrics.FormatPEM))
+	assert.Equal(t, jks, injections(metrics.FormatJKS))
+	assert.Equal(t, mutated+1, requests(metrics.ResultMutated))
+
+	// a pod denied after the JKS truststore is injected counts no injection
+	pod = newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaJksInject] = "true"
+		pod.Annotations[AnnotationMountConflict] = MountConflictDeny
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "team-ca", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "team-ca"}}}})
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "team-ca", MountPath: "/etc/pki/ca-trust/extracted/pem"})
+	})
+	pem, jks, denials := injections(metrics.FormatPEM), injections(metrics.FormatJKS), requests(metrics.ResultDenied)
+	rr = mutateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, pem, injections(metrics.FormatPEM))
+	assert.Equal(t, jks, injections(metrics.FormatJKS))
+	assert.Equal(t, denials+1, requests(metrics.ResultDenied))
+
+	// a dry run counts nothing
+	pem, mutated = injections(metrics.FormatPEM), requests(metrics.ResultMutated)
+	_, err = DryRun([]byte(newTestReview("admission.k8s.io/v1", testPod)))
+	assert.NoError(t, err)
+	assert.Equal(t, pem, injections(metrics.FormatPEM))
+	assert.Equal(t, mutated, requests(metrics.ResultMutated))
+}
+
+func TestValidateRecordsMetrics(t *testing.T) {
+	requests := func(result string) float64 {
+		return testutil.ToFloat64(metrics.ValidationRequests.WithLabelValues(result))
+	}
+
+	allowed := requests(metrics.ResultAllowed)
+	rr := validateTestReview(t, newTestReview("admission.k8s.io/v1", testPod))
+	assert.True(t, rr.Allowed)
+	assert.Equal(t, allowed+1, requests(metrics.ResultAllowed))
+
+	pod := newTestPod(t, func(pod *corev1.Pod) {
+		pod.Annotations[AnnotationCaPemInject] = "yes"
+	})
+	denials := requests(metrics.ResultDenied)
+	rr = validateTestReview(t, newTestReview("admission.k8s.io/v1", pod))
+	assert.False(t, rr.Allowed)
+	assert.Equal(t, denials+1, requests(metrics.ResultDenied))
+
+	errors := requests(metrics.ResultErrored)
+	_, err := Validate([]byte("{"))
+	assert.Error(t, err)
+	assert.Equal(t, errors+1, requests(metrics.ResultErrored))
+}
@@ -0,0 +1,169 @@
+package mutate
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/appscode/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxNamePrefixLength leaves room in a DNS-1123 label for the longest name suffix, -generate-pkcs12, and a collision suffix
+const maxNamePrefixLength = 40
+
+// names are the names of the objects added to the pod for a truststore format
+type names struct {
+	// Volume is the emptyDir the truststore is generated to and mounted from
+	Volume string `json:"volume"`
+	// SourceVolume is the configMap volume of the custom CA
+	SourceVolume string `json:"sourceVolume"`
+	// InitContainer generates the truststore
+	InitContainer string `json:"initContainer"`
+}
+
+// injectedNames are the names chosen for each truststore format, recorded in the injected-names annotation
+type injectedNames map[string]*names
+
+// recordedNames returns the names recorded in the pod by a previous injection, none if the pod was not injected
+func recordedNames(pod *corev1.Pod) (injectedNames, error) {
+	recorded := injectedNames{}
+	value, ok := pod.ObjectMeta.Annotations[AnnotationInjectedNames]
+	if !ok {
+		return recorded, nil
+	}
+	if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+		return nil, &annotationError{AnnotationInjectedNames, value, fmt.Sprintf("must be a JSON object: %v", err)}
+	}
+	return recorded, nil
+}
+
+// initContainers returns the names of the init containers generating the truststores
+func (n injectedNames) initContainers() map[string]bool {
+	containers := map[string]bool{}
+	for _, names := range n {
+		containers[names.InitContainer] = true
+	}
+	return containers
+}
+
+// volumes returns the names of the volumes the truststores are generated to
+func (n injectedNames) volumes() map[string]bool {
+	volumes := map[string]bool{}
+	for _, names := range n {
+		volumes[names.Volume] = true
+	}
+	return volumes
+}
+
+// forFormat returns the names of the format, the recorded ones if the pod was injected already
+// Otherwise the names are made of the prefix and the format, suffixed with -2, -3... when they are taken in the pod
+func (n injectedNames) forFormat(pod *corev1.Pod, prefix, format string) *names {
+	if names, ok := n[format]; ok {
+		return names
+	}
+	volumes := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		volumes[v.Name] = true
+	}
+	containers := map[string]bool{}
+	for _, c := range pod.Spec.Containers {
+		containers[c.Name] = true
+	}
+	for _, c := range pod.Spec.InitContainers {
+		containers[c.Name] = true
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		containers[c.Name] = true
+	}
+	for _, names := range n {
+		volumes[names.Volume] = true
+		volumes[names.SourceVolume] = true
+		containers[names.InitContainer] = true
+	}
+	chosen := &names{
+		Volume:        uniqueName(volumes, fmt.Sprintf("%s-%s", prefix, format)),
+		SourceVolume:  uniqueName(volumes, fmt.Sprintf("%s-%s-source", prefix, format)),
+		InitContainer: uniqueName(containers, fmt.Sprintf("%s-generate-%s", prefix, format)),
+	}
+	n[format] = chosen
+	return chosen
+}
+
+// uniqueName returns name, suffixed with -2, -3... if it is taken, and marks it as taken
+func uniqueName(taken map[string]bool, name string) string {
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// recordNames returns the patch recording the names in the injected-names annotation, none if they are recorded already
+func recordNames(pod *corev1.Pod, n injectedNames) []*jsonpatch.JsonPatchOperation {
+	if len(n) == 0 {
+		return nil
+	}
+	if recorded, err := recordedNames(pod); err == nil && reflect.DeepEqual(recorded, n) {
+		return nil
+	}
+	// a map of strings always marshals
+	value, _ := json.Marshal(n)
+	return addAnnotation(pod, AnnotationInjectedNames, string(value))
+}
+
+// addAnnotation returns the patch setting the annotation of the pod
+func addAnnotation(pod *corev1.Pod, key, value string) []*jsonpatch.JsonPatchOperation {
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+		return []*jsonpatch.JsonPatchOperation{{
+			Operation: "add",
+			Path:      "/metadata/annotations",
+			Value:     map[string]string{key: value},
+		}}
+	}
+	pod.ObjectMeta.Annotations[key] = value
+	// in a JSON pointer, / is escaped as ~1 and ~ as ~0
+	escaped := strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+	return []*jsonpatch.JsonPatchOperation{{
+		Operation: "add",
+		Path:      "/metadata/annotations/" + escaped,
+		Value:     value,
+	}}
+}
+
+func validateNamePrefix(value string) string {
+	if msgs := validation.IsDNS1123Label(value); len(msgs) > 0 {
+		return strings.Join(msgs, ", ")
+	}
+	if len(value) > maxNamePrefixLength {
+		return fmt.Sprintf("must be no more than %d characters", maxNamePrefixLength)
+	}
+	return ""
+}
+
+func validateInjectedNames(value string) string {
+	recorded := injectedNames{}
+	if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+		return fmt.Sprintf("must be a JSON object: %v", err)
+	}
+	for format, names := range recorded {
+		switch format {
+		case envFormatPem, envFormatJks, envFormatPkcs12:
+		default:
+			return fmt.Sprintf("%q is not a truststore format, one of pem, jks or pkcs12", format)
+		}
+		if names == nil {
+			return fmt.Sprintf("the names of %s must be an object", format)
+		}
+		for _, name := range []string{names.Volume, names.SourceVolume, names.InitContainer} {
+			if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+				return fmt.Sprintf("%q of %s is not a valid name: %s", name, format, strings.Join(msgs, ", "))
+			}
+		}
+	}
+	return ""
+}
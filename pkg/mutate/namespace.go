@@ -0,0 +1,36 @@
+package mutate
+
+import "sync"
+
+// NamespaceLabels returns the labels of a namespace
+type NamespaceLabels func(name string) (map[string]string, error)
+
+var (
+	namespaceLabelsMu sync.RWMutex
+	// namespaceLabels reads no label until a lookup is configured, e.g. for the dry runs
+	namespaceLabels NamespaceLabels = func(string) (map[string]string, error) { return nil, nil }
+)
+
+// ConfigureNamespaceLabels replaces the lookup of the namespace labels used for the next admission requests
+func ConfigureNamespaceLabels(lookup NamespaceLabels) {
+	namespaceLabelsMu.Lock()
+	defer namespaceLabelsMu.Unlock()
+	namespaceLabels = lookup
+}
+
+// currentNamespaceLabels returns the lookup of the namespace labels in use
+func currentNamespaceLabels() NamespaceLabels {
+	namespaceLabelsMu.RLock()
+	defer namespaceLabelsMu.RUnlock()
+	return namespaceLabels
+}
+
+// namespaceOptedIn reports if the pods of the namespace are opted in by its inject label
+func namespaceOptedIn(labels map[string]string) bool {
+	return labels[LabelInject] == "true"
+}
+
+// namespaceOptedOut reports if the pods of the namespace are opted out by its inject label
+func namespaceOptedOut(labels map[string]string) bool {
+	return labels[LabelInject] == "false"
+}
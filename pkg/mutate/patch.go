@@ -2,220 +2,449 @@ package mutate
 
 import (
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/appscode/jsonpatch"
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
+	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 )
 
-func addContainer(target []corev1.Container, added []corev1.Container, basePath string) []*jsonpatch.JsonPatchOperation {
+// the add helpers below return the patch adding the elements to the list at basePath
+// target is the list in the pod being patched, the added elements are appended to it so that
+// following patches see the updated pod, e.g. the list does not have to be created a second time
+// Elements whose name is already in the list are skipped, so that a pod which was already
+// injected, e.g. when the webhook is reinvoked, only gets the missing elements
+
+func addContainer(target *[]corev1.Container, added []corev1.Container, basePath string) []*jsonpatch.JsonPatchOperation {
 	var patch []*jsonpatch.JsonPatchOperation
-	first := len(target) == 0
-	var value interface{}
+	existing := map[string]bool{}
+	for _, element := range *target {
+		existing[element.Name] = true
+	}
 	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
+		if existing[add.Name] {
+			log.Debugf("%s already contains %s, it is not added", basePath, add.Name)
+			continue
+		}
+		existing[add.Name] = true
+
+		var value interface{} = add
+		path := basePath + "/-"
+		if len(*target) == 0 {
 			value = []corev1.Container{add}
-		} else {
-			path = path + "/-"
+			path = basePath
 		}
 		patch = append(patch, &jsonpatch.JsonPatchOperation{
 			Operation: "add",
 			Path:      path,
 			Value:     value,
 		})
+		*target = append(*target, add)
 	}
 	return patch
 }
-func addVolumeMounts(target []corev1.VolumeMount, added []corev1.VolumeMount, basePath string) []*jsonpatch.JsonPatchOperation {
+
+func addVolumeMounts(target *[]corev1.VolumeMount, added []corev1.VolumeMount, basePath string) []*jsonpatch.JsonPatchOperation {
 	var patch []*jsonpatch.JsonPatchOperation
-	first := len(target) == 0
-	var value interface{}
+	existing := map[string]bool{}
+	for _, element := range *target {
+		existing[element.Name] = true
+	}
 	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.VolumeMount{add}
-		} else {
-			path = path + "/-"
+		if existing[add.Name] {
+			log.Debugf("%s already contains %s, it is not added", basePath, add.Name)
+			continue
 		}
+		existing[add.Name] = true
 
+		var value interface{} = add
+		path := basePath + "/-"
+		if len(*target) == 0 {
+			value = []corev1.VolumeMount{add}
+			path = basePath
+		}
 		patch = append(patch, &jsonpatch.JsonPatchOperation{
 			Operation: "add",
 			Path:      path,
 			Value:     value,
 		})
+		*target = append(*target, add)
 	}
 	return patch
 }
 
-func addVolume(target []corev1.Volume, added []corev1.Volume, basePath string) []*jsonpatch.JsonPatchOperation {
+func addVolume(target *[]corev1.Volume, added []corev1.Volume, basePath string) []*jsonpatch.JsonPatchOperation {
 	var patch []*jsonpatch.JsonPatchOperation
-	first := len(target) == 0
-	var value interface{}
+	existing := map[string]bool{}
+	for _, element := range *target {
+		existing[element.Name] = true
+	}
 	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
+		if existing[add.Name] {
+			log.Debugf("%s already contains %s, it is not added", basePath, add.Name)
+			continue
+		}
+		existing[add.Name] = true
+
+		var value interface{} = add
+		path := basePath + "/-"
+		if len(*target) == 0 {
 			value = []corev1.Volume{add}
-		} else {
-			path = path + "/-"
+			path = basePath
 		}
 		patch = append(patch, &jsonpatch.JsonPatchOperation{
 			Operation: "add",
 			Path:      path,
 			Value:     value,
 		})
+		*target = append(*target, add)
 	}
 	return patch
 }
 
-func injectPemCA(pod *corev1.Pod) []*jsonpatch.JsonPatchOperation {
-	// define volumeMounts for all the application containers
-	var volumeMounts []corev1.VolumeMount
-	// define volumes
-	var volumes []corev1.Volume
-	// define patch operations
+func addEnv(target *[]corev1.EnvVar, added []corev1.EnvVar, basePath string) []*jsonpatch.JsonPatchOperation {
 	var patch []*jsonpatch.JsonPatchOperation
-	// defines read-only permission for mounting the CA
-	var defaultMode int32 = 0400
+	existing := map[string]bool{}
+	for _, element := range *target {
+		existing[element.Name] = true
+	}
+	for _, add := range added {
+		if existing[add.Name] {
+			log.Debugf("%s already contains %s, it is not added", basePath, add.Name)
+			continue
+		}
+		existing[add.Name] = true
 
-	volumeMounts = append(volumeMounts, corev1.VolumeMount{
-		Name:      "generated-pem",
-		MountPath: pod.ObjectMeta.Annotations[AnnotationCaPemInjectPath],
-		ReadOnly:  true,
-	})
-	volumes = append([]corev1.Volume{}, corev1.Volume{
-		Name: "generated-pem",
-		VolumeSource: corev1.VolumeSource{
-			EmptyDir: &corev1.EmptyDirVolumeSource{},
-		},
-	})
-	volumes = append(volumes, corev1.Volume{
-		Name: "custom-pem",
-		VolumeSource: corev1.VolumeSource{
-			ConfigMap: &corev1.ConfigMapVolumeSource{
-				LocalObjectReference: corev1.LocalObjectReference{
-					Name: (*pod).ObjectMeta.Annotations[AnnotationConfigMap],
-				},
-				Items: []corev1.KeyToPath{
-					{
-						Key:  "ca-bundle.crt",
-						Path: "tls-ca-bundle.pem",
-						Mode: &defaultMode,
+		var value interface{} = add
+		path := basePath + "/-"
+		if len(*target) == 0 {
+			value = []corev1.EnvVar{add}
+			path = basePath
+		}
+		patch = append(patch, &jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path,
+			Value:     value,
+		})
+		*target = append(*target, add)
+	}
+	return patch
+}
+
+// addImagePullSecrets adds the secrets missing from the imagePullSecrets of the pod
+func addImagePullSecrets(target *[]corev1.LocalObjectReference, added []string, basePath string) []*jsonpatch.JsonPatchOperation {
+	var patch []*jsonpatch.JsonPatchOperation
+	existing := map[string]bool{}
+	for _, element := range *target {
+		existing[element.Name] = true
+	}
+	for _, name := range added {
+		if existing[name] {
+			log.Debugf("%s already contains %s, it is not added", basePath, name)
+			continue
+		}
+		existing[name] = true
+
+		add := corev1.LocalObjectReference{Name: name}
+		var value interface{} = add
+		path := basePath + "/-"
+		if len(*target) == 0 {
+			value = []corev1.LocalObjectReference{add}
+			path = basePath
+		}
+		patch = append(patch, &jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path,
+			Value:     value,
+		})
+		*target = append(*target, add)
+	}
+	return patch
+}
+
+// nestsMount reports if the truststore of another format is injected below mountPath
+// The container runtime then has to create the mount point inside the volume of mountPath, hence it cannot be read-only,
+// e.g. /etc/ssl/certs/java in /etc/ssl/certs with the debian profile
+func (s *Settings) nestsMount(mountPath string) bool {
+	for _, f := range truststoreFormats {
+		if inject, dir, _ := f.location(s); inject && strings.HasPrefix(path.Clean(dir), path.Clean(mountPath)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// placementIndex returns the index of the init containers of the pod the placement inserts the init containers before
+// found is false if the init container of a before:<name> placement is not in the pod, which validateAnnotations denies
+func placementIndex(pod *corev1.Pod, placement string) (index int, found bool) {
+	if placement == PlacementLast {
+		return len(pod.Spec.InitContainers), true
+	}
+	if before := strings.TrimPrefix(placement, placementBefore); before != placement {
+		for i, c := range pod.Spec.InitContainers {
+			if c.Name == before {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	return 0, true
+}
+
+// newInjections returns the formats generated by init containers missing from the pod, none if the pod was already injected
+func newInjections(pod *corev1.Pod, generators []generator) []string {
+	existing := map[string]bool{}
+	for _, c := range pod.Spec.InitContainers {
+		existing[c.Name] = true
+	}
+	var formats []string
+	for _, g := range generators {
+		for _, c := range g.containers {
+			if !existing[c.Name] {
+				formats = append(formats, g.format)
+				break
+			}
+		}
+	}
+	return formats
+}
+
+// insertInitContainers returns the patch inserting the init containers generating the truststores at the placement:
+// first, last or before:<name> of an init container of the application
+// Restricted init containers also get the RuntimeDefault seccomp profile
+// It must follow the patches of the init containers of the application, whose indexes it shifts
+func insertInitContainers(pod *corev1.Pod, in *Settings, added []corev1.Container) []*jsonpatch.JsonPatchOperation {
+	placement := in.InitContainerPlacement
+	existing := map[string]bool{}
+	for _, c := range pod.Spec.InitContainers {
+		existing[c.Name] = true
+	}
+	var missing []corev1.Container
+	for _, c := range added {
+		if existing[c.Name] {
+			log.Debugf("/spec/initContainers already contains %s, it is not added", c.Name)
+			continue
+		}
+		missing = append(missing, c)
+	}
+	// the pods missing the init container of a before:<name> placement are denied by validateAnnotations
+	index, _ := placementIndex(pod, placement)
+	var patch []*jsonpatch.JsonPatchOperation
+	if index == len(pod.Spec.InitContainers) {
+		patch = addContainer(&pod.Spec.InitContainers, missing, "/spec/initContainers")
+	} else {
+		for i, c := range missing {
+			patch = append(patch, &jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      fmt.Sprintf("/spec/initContainers/%d", index+i),
+				Value:     c,
+			})
+		}
+		inserted := append(append(append([]corev1.Container{}, pod.Spec.InitContainers[:index]...), missing...), pod.Spec.InitContainers[index:]...)
+		pod.Spec.InitContainers = inserted
+	}
+	// the seccomp profile cannot be set in the containers, as the vendored API predates it
+	for i, c := range missing {
+		if c.SecurityContext != nil {
+			patch = append(patch, addSeccompProfile(index+i))
+		}
+	}
+	return patch
+}
+
+// mountToTargets mounts the volume to the targets at the directory returned by location for their settings,
+// or only the file of the truststore in the directory with the file mount mode
+// Targets for which location returns an empty directory do not get the volume. A target already mounting another volume
+// at the path, above or below it, does not get it either, or gets it in place of the other volumes, or makes the pod denied,
+// as per its mount conflict policy. The truststore volumes given by injected never conflict, as they are nested on purpose
+func mountToTargets(pod *corev1.Pod, ts []target, volume string, injected map[string]bool, location func(*Settings) (dir, file string)) ([]*jsonpatch.JsonPatchOperation, error) {
+	var patch []*jsonpatch.JsonPatchOperation
+	for _, t := range ts {
+		dir, file := location(t.settings)
+		if dir == "" {
+			continue
+		}
+		mount := corev1.VolumeMount{
+			Name:      volume,
+			MountPath: dir,
+			ReadOnly:  !t.settings.nestsMount(dir),
+		}
+		if t.settings.MountMode == MountModeFile {
+			mount.MountPath = path.Join(dir, file)
+			mount.SubPath = file
+			mount.ReadOnly = true
+		}
+		c := t.container(pod)
+		conflict := conflictingMount(c, mount.MountPath, injected)
+		if conflict >= 0 {
+			existing := c.VolumeMounts[conflict]
+			switch t.settings.MountConflict {
+			case MountConflictDeny:
+				return nil, &mountConflictError{container: c.Name, volume: existing.Name, volumePath: existing.MountPath, truststore: volume, mountPath: mount.MountPath}
+			case MountConflictReplace:
+				// the conflicting mounts are removed below
+			default:
+				log.Warnf("Container %s already mounts %s at %s, %s is not mounted at %s", c.Name, existing.Name, existing.MountPath, volume, mount.MountPath)
+				continue
+			}
+		}
+		// every conflicting mount is replaced, e.g. the mounts of a directory and of a file below it
+		for ; conflict >= 0; conflict = conflictingMount(c, mount.MountPath, injected) {
+			log.Infof("Container %s mounts %s at %s, it is replaced by %s at %s", c.Name, c.VolumeMounts[conflict].Name, c.VolumeMounts[conflict].MountPath, volume, mount.MountPath)
+			patch = append(patch, &jsonpatch.JsonPatchOperation{
+				Operation: "remove",
+				Path:      fmt.Sprintf("%s/%d", t.path("volumeMounts"), conflict),
+			})
+			c.VolumeMounts = append(c.VolumeMounts[:conflict:conflict], c.VolumeMounts[conflict+1:]...)
+		}
+		patch = append(patch, addVolumeMounts(&c.VolumeMounts, []corev1.VolumeMount{mount}, t.path("volumeMounts"))...)
+	}
+	return patch, nil
+}
+
+// conflictingMount returns the index of the mount of a volume other than the injected ones at mountPath,
+// or at a directory above or below it, in the container, -1 if there is none
+// A mount above mountPath would need the mount point created in its volume, one below in the truststore volume
+func conflictingMount(c *corev1.Container, mountPath string, injected map[string]bool) int {
+	for i, m := range c.VolumeMounts {
+		if !injected[m.Name] && overlaps(m.MountPath, mountPath) {
+			return i
+		}
+	}
+	return -1
+}
+
+// overlaps reports if the paths are the same or one is a directory containing the other
+func overlaps(a, b string) bool {
+	a, b = path.Clean(a), path.Clean(b)
+	return a == b || strings.HasPrefix(b, strings.TrimSuffix(a, "/")+"/") || strings.HasPrefix(a, strings.TrimSuffix(b, "/")+"/")
+}
+
+// buildTruststoreCommand returns the command of an init container running the build-truststore command of the injector image
+// The custom CAs are read from custom, filtered and merged with the CAs of the base bundle into the output given by the flags,
+// written with the file mode
+func buildTruststoreCommand(in *Settings, custom string, mode int32, output ...string) []string {
+	command := append([]string{"/app/custom-ca-injector", "build-truststore", "-base", in.BaseBundle, "-custom", custom, "-mode", fmt.Sprintf("%#o", mode)}, output...)
+	return append(command, in.Filter.args()...)
+}
+
+// passwordEnv returns the environment of the init containers building password protected truststores
+// The password is read from the secret by the kubelet, so it never appears in the pod spec
+func passwordEnv(in *Settings, name string) []corev1.EnvVar {
+	if in.PasswordSecret == "" {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: in.PasswordSecret,
 					},
+					Key: in.PasswordSecretKey,
 				},
 			},
-		}})
-	initContainers := append([]corev1.Container{}, corev1.Container{
-		Name:  "generate-pem-truststore",
-		Image: (*pod).ObjectMeta.Annotations[AnnotationImage],
-		Command: []string{
-			"sh",
-			"-xc",
-			"ls -ld /generated && cp /custom/tls-ca-bundle.pem /generated/custom.pem && cp /etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem /generated/base.pem && awk 'BEGIN {RS=\"-----END CERTIFICATE-----\"} {certs[$0] = $0 RS;} END {for(pem in certs) print certs[pem]}' /generated/*pem > /generated/tls-ca-bundle.pem && rm /generated/custom.pem /generated/base.pem",
 		},
-		VolumeMounts: []corev1.VolumeMount{
-			{
-				Name:      "generated-pem",
-				MountPath: "/generated",
-			},
-			{
-				Name:      "custom-pem",
-				MountPath: "/custom",
-			},
-		},
-	},
-	)
-	patch = append(patch, addVolume((*pod).Spec.Volumes, volumes, "/spec/volumes")...)
-	for i, cont := range (*pod).Spec.Containers {
-		patch = append(patch, addVolumeMounts(cont.VolumeMounts, volumeMounts, fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
 	}
-	for i, cont := range (*pod).Spec.InitContainers {
-		if cont.Name != "generate-pem-truststore" {
-			patch = append(patch, addVolumeMounts(cont.VolumeMounts, volumeMounts, fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))...)
+}
+
+// envToTargets adds the password and the runtime environment variables of their settings to the targets
+// A variable already defined by a container is kept, so that the pod spec always wins
+func envToTargets(pod *corev1.Pod, ts []target) []*jsonpatch.JsonPatchOperation {
+	var patch []*jsonpatch.JsonPatchOperation
+	for _, t := range ts {
+		var env []corev1.EnvVar
+		if (t.settings.InjectJks || t.settings.InjectPkcs12) && t.settings.PasswordEnv != "" {
+			env = passwordEnv(t.settings, t.settings.PasswordEnv)
 		}
+		env = append(env, t.settings.envVars()...)
+
+		c := t.container(pod)
+		defined := map[string]bool{}
+		for _, e := range c.Env {
+			defined[e.Name] = true
+		}
+		var added []corev1.EnvVar
+		for _, e := range env {
+			if defined[e.Name] {
+				log.Warnf("Container %s already defines %s, it is not injected", c.Name, e.Name)
+				continue
+			}
+			added = append(added, e)
+		}
+		patch = append(patch, addEnv(&c.Env, added, t.path("env"))...)
 	}
-	patch = append(patch, addContainer((*pod).Spec.InitContainers, initContainers, "/spec/initContainers")...)
 	return patch
 }
 
-func injectJksCA(pod *corev1.Pod) []*jsonpatch.JsonPatchOperation {
-	// define volumeMounts for all the application containers
-	var volumeMounts []corev1.VolumeMount
-	// define volumes
-	var volumes []corev1.Volume
-	// define patch operations
-	var patch []*jsonpatch.JsonPatchOperation
-	// defines read-only permission for mounting the CA
-	var defaultMode int32 = 0400
-
-	volumeMounts = append([]corev1.VolumeMount{}, corev1.VolumeMount{
-		Name:      "trusted-ca-jks",
-		MountPath: pod.ObjectMeta.Annotations[AnnotationCaJksInjectPath],
-		ReadOnly:  true,
-	})
-	volumes = append([]corev1.Volume{}, corev1.Volume{
-		Name: "trusted-ca-jks",
-		VolumeSource: corev1.VolumeSource{
-			EmptyDir: &corev1.EmptyDirVolumeSource{},
+// injectTruststore returns the patch adding the volumes of the format and mounting its truststore to the targets,
+// and the init container generating it from the custom CAs of the configMap
+// The truststore volumes given by injected, including the one of the format, may be mounted above or below it
+func injectTruststore(pod *corev1.Pod, in *Settings, f truststoreFormat, n *names, injected map[string]bool, ts []target) ([]*jsonpatch.JsonPatchOperation, []corev1.Container, error) {
+	// the custom CA is read by the init container, the truststore by the targets
+	sourceMode := sourceMode(pod)
+	volumes := []corev1.Volume{
+		{
+			Name: n.Volume,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: in.emptyDir(),
+			},
 		},
-	})
-	volumes = append(volumes, corev1.Volume{
-		Name: "trusted-ca-pem",
-		VolumeSource: corev1.VolumeSource{
-			ConfigMap: &corev1.ConfigMapVolumeSource{
-				LocalObjectReference: corev1.LocalObjectReference{
-					Name: (*pod).ObjectMeta.Annotations[AnnotationConfigMap],
-				},
-				Items: []corev1.KeyToPath{
-					{
-						Key:  "ca-bundle.crt",
-						Path: "tls-ca-bundle.pem",
-						Mode: &defaultMode,
+		{
+			Name: n.SourceVolume,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: in.ConfigMap,
+					},
+					Items: []corev1.KeyToPath{
+						{
+							Key:  "ca-bundle.crt",
+							Path: "tls-ca-bundle.pem",
+							Mode: &sourceMode,
+						},
 					},
 				},
 			},
-		}})
-	initContainers := append([]corev1.Container{}, corev1.Container{
-		Name:  "generate-jks-truststore",
-		Image: (*pod).ObjectMeta.Annotations[AnnotationImage],
-		Command: []string{
-			"sh",
-			"-xc",
-			fmt.Sprintf(`cp /etc/pki/ca-trust/extracted/java/cacerts /jks/cacerts && \
-					chmod 644 /jks/cacerts && \
-					csplit -z -f /tmp/crt- /pem/tls-ca-bundle.pem '/-----BEGIN CERTIFICATE-----/' '{*}' && \
-					for file in /tmp/crt*; do
-					   keytool -noprompt -import -trustcacerts -file $file -alias $file -keystore /jks/cacerts -storepass changeit
-				     done && \
-				     chmod 400 /jks/cacerts`),
 		},
+	}
+	_, _, file := f.location(in)
+	generate := corev1.Container{
+		Name:            n.InitContainer,
+		Image:           in.InitContainerImage,
+		ImagePullPolicy: corev1.PullPolicy(in.ImagePullPolicy),
+		SecurityContext: in.initContainerSecurityContext(pod),
+		Resources:       in.initContainerResources(),
+		Command:         buildTruststoreCommand(in, "/custom/tls-ca-bundle.pem", outputMode(pod, ts), f.flag, path.Join("/generated", file)),
 		VolumeMounts: []corev1.VolumeMount{
 			{
-				Name:      "trusted-ca-pem",
-				MountPath: "/pem",
+				Name:      n.Volume,
+				MountPath: "/generated",
 			},
 			{
-				Name:      "trusted-ca-jks",
-				MountPath: "/jks",
+				Name:      n.SourceVolume,
+				MountPath: "/custom",
 			},
 		},
-	},
-	)
-	patch = append(patch, addVolume((*pod).Spec.Volumes, volumes, "/spec/volumes")...)
-	for i, cont := range pod.Spec.Containers {
-		patch = append(patch, addVolumeMounts(cont.VolumeMounts, volumeMounts, fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
 	}
-	for i, cont := range pod.Spec.InitContainers {
-		if cont.Name != "generate-jks-truststore" {
-			patch = append(patch, addVolumeMounts(cont.VolumeMounts, volumeMounts, fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))...)
-		}
+	if f.protected {
+		generate.Env = passwordEnv(in, truststore.PasswordEnv)
 	}
-	patch = append(patch, addContainer((*pod).Spec.InitContainers, initContainers, "/spec/initContainers")...)
 
-	return patch
+	patch := addVolume(&pod.Spec.Volumes, volumes, "/spec/volumes")
+	mounts, err := mountToTargets(pod, ts, n.Volume, injected, func(s *Settings) (string, string) {
+		if inject, dir, file := f.location(s); inject {
+			return dir, file
+		}
+		return "", ""
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	patch = append(patch, mounts...)
+	// the init container is inserted by insertInitContainers, as it shifts the init containers of the application
+	return patch, []corev1.Container{generate}, nil
 }
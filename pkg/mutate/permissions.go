@@ -0,0 +1,93 @@
+package mutate
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// the modes of the truststore files, from the most to the least restrictive
+const (
+	ownerReadable int32 = 0400
+	groupReadable int32 = 0440
+	worldReadable int32 = 0444
+)
+
+// podRunAsUser returns the UID the containers of the pod run as when they do not set one, nil for the UID of their image
+func podRunAsUser(pod *corev1.Pod) *int64 {
+	if pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	return pod.Spec.SecurityContext.RunAsUser
+}
+
+// podFSGroup returns the group owning the volumes of the pod, nil if the pod has none
+func podFSGroup(pod *corev1.Pod) *int64 {
+	if pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	return pod.Spec.SecurityContext.FSGroup
+}
+
+// runAsUser returns the UID the container runs as, nil for the UID of its image
+func runAsUser(pod *corev1.Pod, c *corev1.Container) *int64 {
+	if c.SecurityContext != nil && c.SecurityContext.RunAsUser != nil {
+		return c.SecurityContext.RunAsUser
+	}
+	return podRunAsUser(pod)
+}
+
+// outputMode returns the mode of the truststores generated by the init containers, which run as the UID of the pod
+// The truststores are only readable by their owner when every target runs as the UID of the init containers,
+// by the fsGroup of the pod when it has one, and by everyone otherwise, e.g. for the arbitrary UIDs of OpenShift
+func outputMode(pod *corev1.Pod, ts []target) int32 {
+	if uid := podRunAsUser(pod); uid != nil {
+		sameUser := true
+		for _, t := range ts {
+			if targetUID := runAsUser(pod, t.container(pod)); targetUID == nil || *targetUID != *uid {
+				sameUser = false
+				break
+			}
+		}
+		if sameUser {
+			return ownerReadable
+		}
+	}
+	if podFSGroup(pod) != nil {
+		return groupReadable
+	}
+	return worldReadable
+}
+
+// sourceMode returns the mode of the custom CAs mounted from the configMap, which the kubelet writes as root
+// and the fsGroup of the pod, so that the init containers can read them without running as root
+func sourceMode(pod *corev1.Pod) int32 {
+	if uid := podRunAsUser(pod); uid != nil && *uid == 0 {
+		return ownerReadable
+	}
+	if podFSGroup(pod) != nil {
+		return groupReadable
+	}
+	return worldReadable
+}
+
+// emptyDir returns the source of the volumes the truststores are generated to
+func (s *Settings) emptyDir() *corev1.EmptyDirVolumeSource {
+	source := &corev1.EmptyDirVolumeSource{
+		Medium: corev1.StorageMedium(s.EmptyDirMedium),
+	}
+	// the size limit is validated with the settings and the annotations
+	if limit, err := resource.ParseQuantity(s.EmptyDirSizeLimit); err == nil {
+		source.SizeLimit = &limit
+	}
+	return source
+}
+
+func validateEmptyDirMedium(value string) string {
+	switch corev1.StorageMedium(value) {
+	case corev1.StorageMediumDefault, corev1.StorageMediumMemory:
+		return ""
+	}
+	return fmt.Sprintf("must be empty for the storage of the node or %s", corev1.StorageMediumMemory)
+}
@@ -0,0 +1,78 @@
+package mutate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profile holds where a Linux distribution keeps its CAs in the images of the pod
+// The base bundle is not part of it, as it is read from the injector image whatever the distribution of the pod,
+// unless the ProfileBaseBundles setting overrides it for an init container image of that distribution
+type profile struct {
+	pemPath string
+	pemFile string
+	jksPath string
+	jksFile string
+	// mountMode is the file mount mode where the truststore directories hold other files, e.g. the hash links of /etc/ssl/certs
+	mountMode string
+}
+
+// etcSSLCerts is the layout of the distributions keeping their CAs in /etc/ssl/certs
+var etcSSLCerts = profile{
+	pemPath:   "/etc/ssl/certs",
+	pemFile:   "ca-certificates.crt",
+	jksPath:   "/etc/ssl/certs/java",
+	jksFile:   "cacerts",
+	mountMode: MountModeFile,
+}
+
+// profiles are the built-in distribution profiles, selected by name with the profile annotation
+var profiles = map[string]profile{
+	"rhel": {
+		pemPath:   "/etc/pki/ca-trust/extracted/pem",
+		pemFile:   "tls-ca-bundle.pem",
+		jksPath:   "/etc/pki/ca-trust/extracted/java",
+		jksFile:   "cacerts",
+		mountMode: MountModeDirectory,
+	},
+	"debian":     etcSSLCerts,
+	"alpine":     etcSSLCerts,
+	"distroless": etcSSLCerts,
+}
+
+// applyProfile replaces the PEM and JKS paths, their file names and the mount mode with the ones of the profile,
+// and the base bundle with the one of ProfileBaseBundles for the profile, if any
+func (s *Settings) applyProfile() {
+	p, ok := profiles[s.Profile]
+	if !ok {
+		return
+	}
+	if bundle, ok := s.ProfileBaseBundles[s.Profile]; ok {
+		s.BaseBundle = bundle
+	}
+	s.InjectPemPath = p.pemPath
+	s.InjectPemFile = p.pemFile
+	s.InjectJksPath = p.jksPath
+	s.InjectJksFile = p.jksFile
+	s.MountMode = p.mountMode
+}
+
+func validateProfile(value string) string {
+	if _, ok := profiles[value]; ok {
+		return ""
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("must be one of %s", strings.Join(names, ", "))
+}
+
+func validateFileName(value string) string {
+	if value == "" || value == "." || value == ".." || strings.Contains(value, "/") {
+		return "must be a file name, without '/'"
+	}
+	return ""
+}
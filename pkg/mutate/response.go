@@ -0,0 +1,72 @@
+package mutate
+
+import (
+	"fmt"
+	"path"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotationError explains why the value of an annotation was rejected
+type annotationError struct {
+	annotation string
+	value      string
+	reason     string
+}
+
+func (e *annotationError) Error() string {
+	return fmt.Sprintf("invalid value %q for annotation %s: %s", e.value, e.annotation, e.reason)
+}
+
+// mountConflictError explains why a truststore cannot be mounted to a container
+type mountConflictError struct {
+	container  string
+	volume     string
+	volumePath string
+	truststore string
+	mountPath  string
+}
+
+func (e *mountConflictError) Error() string {
+	if path.Clean(e.volumePath) != path.Clean(e.mountPath) {
+		return fmt.Sprintf("container %s already mounts volume %s at %s, overlapping %s where the truststore volume %s is mounted: set the %s annotation to skip or replace to resolve the conflict",
+			e.container, e.volume, e.volumePath, e.mountPath, e.truststore, AnnotationMountConflict)
+	}
+	return fmt.Sprintf("container %s already mounts volume %s at %s, where the truststore volume %s is mounted: set the %s annotation to skip or replace to resolve the conflict",
+		e.container, e.volume, e.mountPath, e.truststore, AnnotationMountConflict)
+}
+
+// allowed admits the pod without changes
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// patched admits the pod with the JSON patch applied
+func patched(patch []byte) *admissionv1.AdmissionResponse {
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+		Result: &metav1.Status{
+			Message: "Success",
+			Status:  metav1.StatusSuccess,
+		},
+	}
+}
+
+// denied rejects the pod, message is shown to the user creating it
+func denied(code int32, reason metav1.StatusReason, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+}
@@ -0,0 +1,103 @@
+package mutate
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// decodeReview loads the AdmissionReview sent by the K8S API
+// Both admission.k8s.io/v1 and admission.k8s.io/v1beta1 are accepted; the request
+// is converted to v1 and the version it came in is kept so we can answer in the same one
+// A review without apiVersion is handled as v1beta1, as this was the only version served before
+func decodeReview(body []byte) (*review, error) {
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, fmt.Errorf("Decoding failed with error: %v", err)
+	}
+
+	switch typeMeta.APIVersion {
+	case admissionv1.SchemeGroupVersion.String():
+		ar := &admissionv1.AdmissionReview{}
+		if _, _, err := codecs.UniversalDeserializer().Decode(body, nil, ar); err != nil {
+			return nil, fmt.Errorf("Decoding failed with error: %v", err)
+		}
+		return &review{version: admissionv1.SchemeGroupVersion, request: ar.Request}, nil
+	case admissionv1beta1.SchemeGroupVersion.String(), "":
+		ar := &admissionv1beta1.AdmissionReview{}
+		if _, _, err := codecs.UniversalDeserializer().Decode(body, nil, ar); err != nil {
+			return nil, fmt.Errorf("Decoding failed with error: %v", err)
+		}
+		return &review{version: admissionv1beta1.SchemeGroupVersion, request: requestFromV1beta1(ar.Request)}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported AdmissionReview version %s", typeMeta.APIVersion)
+	}
+}
+
+// encode wraps the response in an AdmissionReview of the same version as the request
+func (r *review) encode(response *admissionv1.AdmissionResponse) ([]byte, error) {
+	switch r.version {
+	case admissionv1.SchemeGroupVersion:
+		return json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: admissionv1.SchemeGroupVersion.String(),
+				Kind:       "AdmissionReview",
+			},
+			Response: response,
+		})
+	case admissionv1beta1.SchemeGroupVersion:
+		return json.Marshal(&admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: admissionv1beta1.SchemeGroupVersion.String(),
+				Kind:       "AdmissionReview",
+			},
+			Response: responseToV1beta1(response),
+		})
+	default:
+		return nil, fmt.Errorf("Unsupported AdmissionReview version %s", r.version)
+	}
+}
+
+func requestFromV1beta1(in *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+func responseToV1beta1(in *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	if in == nil {
+		return nil
+	}
+	out := &admissionv1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		AuditAnnotations: in.AuditAnnotations,
+	}
+	if in.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*in.PatchType)
+		out.PatchType = &patchType
+	}
+	return out
+}
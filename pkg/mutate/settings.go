@@ -0,0 +1,247 @@
+package mutate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings holds the server-level settings of the injection
+// Annotations on the pod take precedence over them
+type Settings struct {
+	// InjectPem defines if PEM is injected when the pod has no inject-pem annotation
+	InjectPem bool `json:"injectPem"`
+
+	// InjectPemPath defines where the PEM truststore is injected
+	InjectPemPath string `json:"injectPemPath"`
+
+	// InjectPemFile defines the file name of the PEM truststore in InjectPemPath
+	InjectPemFile string `json:"injectPemFile"`
+
+	// InjectJks defines if JKS is injected when the pod has no inject-jks annotation
+	InjectJks bool `json:"injectJks"`
+
+	// InjectJksPath defines where the JKS truststore is injected
+	InjectJksPath string `json:"injectJksPath"`
+
+	// InjectJksFile defines the file name of the JKS truststore in InjectJksPath
+	InjectJksFile string `json:"injectJksFile"`
+
+	// InjectPkcs12 defines if PKCS#12 is injected when the pod has no inject-pkcs12 annotation
+	InjectPkcs12 bool `json:"injectPkcs12"`
+
+	// InjectPkcs12Path defines where the PKCS#12 truststore is injected
+	InjectPkcs12Path string `json:"injectPkcs12Path"`
+
+	// InjectPkcs12File defines the file name of the PKCS#12 truststore in InjectPkcs12Path
+	InjectPkcs12File string `json:"injectPkcs12File"`
+
+	// MountMode defines if the truststores are mounted over their directory, or as a single file keeping the rest of the directory
+	MountMode string `json:"mountMode"`
+
+	// MountConflict defines the policy when a container already mounts a volume at the path of a truststore: skip, replace or deny
+	MountConflict string `json:"mountConflict"`
+
+	// EmptyDirMedium defines the medium of the volumes the truststores are generated to, Memory for a tmpfs, the node storage if empty
+	EmptyDirMedium string `json:"emptyDirMedium,omitempty"`
+
+	// EmptyDirSizeLimit defines the size limit of the volumes the truststores are generated to, e.g. 10Mi, none if empty
+	EmptyDirSizeLimit string `json:"emptyDirSizeLimit,omitempty"`
+
+	// Containers lists the only containers and init containers the truststores are injected to, all if empty
+	Containers []string `json:"containers,omitempty"`
+
+	// ExcludeContainers lists the containers and init containers the truststores are not injected to, e.g. sidecars
+	ExcludeContainers []string `json:"excludeContainers,omitempty"`
+
+	// Profile defines the distribution profile, which replaces the PEM and JKS paths and file names and the mount mode
+	Profile string `json:"profile,omitempty"`
+
+	// BaseBundle defines the bundle of the public CAs in the init container image, i.e. the injector image, merged with the custom CAs
+	BaseBundle string `json:"baseBundle"`
+
+	// ProfileBaseBundles overrides BaseBundle by profile, for init container images other than the injector image keeping
+	// their public CAs where their distribution does
+	ProfileBaseBundles map[string]string `json:"profileBaseBundles,omitempty"`
+
+	// InitContainerImage defines the image of the init containers, which run the build-truststore command of the injector
+	InitContainerImage string `json:"initContainerImage"`
+
+	// ImagePullPolicy defines the image pull policy of the init containers, the one of Kubernetes for their image if empty
+	ImagePullPolicy string `json:"imagePullPolicy,omitempty"`
+
+	// ImagePullSecrets lists the secrets added to the imagePullSecrets of the pod to pull the image of the init containers
+	ImagePullSecrets []string `json:"imagePullSecrets,omitempty"`
+
+	// InitContainerPlacement defines where the init containers are inserted: first, last or before:<name> of an init container
+	InitContainerPlacement string `json:"initContainerPlacement"`
+
+	// RestrictedInitContainers defines if the init containers get a securityContext complying with the restricted pod security standard
+	RestrictedInitContainers bool `json:"restrictedInitContainers"`
+
+	// InitContainerCPURequest defines the CPU request of the init containers, none if empty
+	InitContainerCPURequest string `json:"initContainerCpuRequest,omitempty"`
+
+	// InitContainerMemoryRequest defines the memory request of the init containers, none if empty
+	InitContainerMemoryRequest string `json:"initContainerMemoryRequest,omitempty"`
+
+	// InitContainerCPULimit defines the CPU limit of the init containers, none if empty
+	InitContainerCPULimit string `json:"initContainerCpuLimit,omitempty"`
+
+	// InitContainerMemoryLimit defines the memory limit of the init containers, none if empty
+	InitContainerMemoryLimit string `json:"initContainerMemoryLimit,omitempty"`
+
+	// ConfigMap defines the name of the configMap containing the custom CA
+	ConfigMap string `json:"configMap"`
+
+	// NamePrefix defines the prefix of the names of the volumes and init containers added to the pod
+	NamePrefix string `json:"namePrefix"`
+
+	// PasswordSecret defines the secret containing the password of the JKS and PKCS#12 truststores, changeit is used if empty
+	PasswordSecret string `json:"passwordSecret,omitempty"`
+
+	// PasswordSecretKey defines the key of the password in PasswordSecret
+	PasswordSecretKey string `json:"passwordSecretKey"`
+
+	// PasswordEnv defines the environment variable exposing the password to the containers, not exposed if empty
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+
+	// InjectEnv lists the presets and variables pointing the containers at the truststores, none by default
+	InjectEnv []string `json:"injectEnv,omitempty"`
+
+	// Filter selects the CAs of the configMap added to the merged CA, all of them by default
+	Filter CertificateFilter `json:"filter,omitempty"`
+}
+
+// DefaultSettings returns the built-in settings
+func DefaultSettings() Settings {
+	return Settings{
+		InjectPem:                  DefaultInjectPem,
+		InjectPemPath:              DefaultInjectPemPath,
+		InjectPemFile:              DefaultInjectPemFile,
+		InjectJks:                  DefaultInjectJks,
+		InjectJksPath:              DefaultInjectJksPath,
+		InjectJksFile:              DefaultInjectJksFile,
+		InjectPkcs12:               DefaultInjectPkcs12,
+		InjectPkcs12Path:           DefaultInjectPkcs12Path,
+		InjectPkcs12File:           DefaultInjectPkcs12File,
+		MountMode:                  DefaultMountMode,
+		MountConflict:              DefaultMountConflict,
+		BaseBundle:                 DefaultBaseBundle,
+		InitContainerImage:         DefaultInitContainerImage,
+		InitContainerPlacement:     DefaultInitContainerPlacement,
+		RestrictedInitContainers:   DefaultRestrictedInitContainers,
+		InitContainerCPURequest:    DefaultInitContainerCPURequest,
+		InitContainerMemoryRequest: DefaultInitContainerMemoryRequest,
+		InitContainerCPULimit:      DefaultInitContainerCPULimit,
+		InitContainerMemoryLimit:   DefaultInitContainerMemoryLimit,
+		ConfigMap:                  DefaultConfigMap,
+		NamePrefix:                 DefaultNamePrefix,
+		PasswordSecretKey:          DefaultPasswordSecretKey,
+	}
+}
+
+// Validate returns a message for each invalid setting, prefixed with its field name
+// The same rules as for the annotations overriding the settings apply
+func (s Settings) Validate() []string {
+	var msgs []string
+	for _, field := range []struct {
+		name     string
+		value    string
+		validate func(string) string
+	}{
+		{"injectPemPath", s.InjectPemPath, validateMountPath},
+		{"injectPemFile", s.InjectPemFile, validateFileName},
+		{"injectJksPath", s.InjectJksPath, validateMountPath},
+		{"injectJksFile", s.InjectJksFile, validateFileName},
+		{"injectPkcs12Path", s.InjectPkcs12Path, validateMountPath},
+		{"injectPkcs12File", s.InjectPkcs12File, validateFileName},
+		{"mountMode", s.MountMode, validateMountMode},
+		{"mountConflict", s.MountConflict, validateMountConflict},
+		{"emptyDirMedium", s.EmptyDirMedium, validateEmptyDirMedium},
+		{"emptyDirSizeLimit", s.EmptyDirSizeLimit, optional(validateQuantity)},
+		{"profile", s.Profile, optional(validateProfile)},
+		{"baseBundle", s.BaseBundle, optional(validateMountPath)},
+		{"initContainerImage", s.InitContainerImage, validateImage},
+		{"imagePullPolicy", s.ImagePullPolicy, optional(validatePullPolicy)},
+		{"imagePullSecrets", strings.Join(s.ImagePullSecrets, ","), validatePullSecrets},
+		{"initContainerPlacement", s.InitContainerPlacement, validatePlacement},
+		{"initContainerCpuRequest", s.InitContainerCPURequest, optional(validateQuantity)},
+		{"initContainerMemoryRequest", s.InitContainerMemoryRequest, optional(validateQuantity)},
+		{"initContainerCpuLimit", s.InitContainerCPULimit, optional(validateQuantity)},
+		{"initContainerMemoryLimit", s.InitContainerMemoryLimit, optional(validateQuantity)},
+		{"configMap", s.ConfigMap, validateObjectName},
+		{"namePrefix", s.NamePrefix, validateNamePrefix},
+		{"passwordSecret", s.PasswordSecret, optional(validateObjectName)},
+		{"passwordSecretKey", s.PasswordSecretKey, validateSecretKey},
+		{"passwordEnv", s.PasswordEnv, optional(validateEnvName)},
+	} {
+		if reason := field.validate(field.value); reason != "" {
+			msgs = append(msgs, fmt.Sprintf("%s %q: %s", field.name, field.value, reason))
+		}
+	}
+	profiles := make([]string, 0, len(s.ProfileBaseBundles))
+	for profile := range s.ProfileBaseBundles {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		if reason := validateProfile(profile); reason != "" {
+			msgs = append(msgs, fmt.Sprintf("profileBaseBundles %q: %s", profile, reason))
+		} else if reason := optional(validateMountPath)(s.ProfileBaseBundles[profile]); reason != "" {
+			msgs = append(msgs, fmt.Sprintf("profileBaseBundles.%s %q: %s", profile, s.ProfileBaseBundles[profile], reason))
+		}
+	}
+	for _, b := range s.initContainerResourceBounds() {
+		if b.exceeded() {
+			msgs = append(msgs, fmt.Sprintf("%s %q: must not exceed %s %q", b.requestField, *b.request, b.limitField, *b.limit))
+		}
+	}
+	// the profile replaces the paths once the settings are used
+	profiled := s
+	profiled.applyProfile()
+	if first, second, ok := profiled.sharedMountPath(); ok {
+		_, dir, _ := second.location(&profiled)
+		msgs = append(msgs, fmt.Sprintf("%s %q: must not mount the %s truststore at %s, where the %s truststore is mounted", second.pathField, dir, second.label, second.mountPath(&profiled), first.label))
+	}
+	for _, field := range []struct {
+		name  string
+		value []string
+	}{
+		{"containers", s.Containers},
+		{"excludeContainers", s.ExcludeContainers},
+	} {
+		if reason := validateContainerNames(strings.Join(field.value, ",")); reason != "" {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", field.name, reason))
+		}
+	}
+	for _, entry := range s.InjectEnv {
+		if reason := validateEnvEntry(entry); reason != "" {
+			msgs = append(msgs, fmt.Sprintf("injectEnv: %s", reason))
+		}
+	}
+	if _, err := s.Filter.compile(); err != nil {
+		msgs = append(msgs, fmt.Sprintf("filter: %v", err))
+	}
+	return msgs
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   = DefaultSettings()
+)
+
+// Configure replaces the settings used for the next admission requests
+func Configure(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = s
+}
+
+// currentSettings returns the settings in use
+func currentSettings() Settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings
+}
@@ -0,0 +1,189 @@
+package mutate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// containerAnnotations are the annotations which can be overridden per container,
+// by prefixing them with the name of the container, e.g. app.custompki.openshift.io/inject-jks
+var containerAnnotations = []string{
+	AnnotationCaPemInject,
+	AnnotationCaPemInjectPath,
+	AnnotationCaJksInject,
+	AnnotationCaJksInjectPath,
+	AnnotationCaPkcs12Inject,
+	AnnotationCaPkcs12InjectPath,
+	AnnotationMountMode,
+	AnnotationMountConflict,
+	AnnotationInjectEnv,
+}
+
+// containerAnnotation returns the annotation overriding annotation for the container
+func containerAnnotation(container, annotation string) string {
+	return container + "." + annotation
+}
+
+// splitContainerAnnotation returns the container and the annotation it overrides
+// ok is false if key is not a per container annotation
+func splitContainerAnnotation(key string) (container, annotation string, ok bool) {
+	for _, annotation := range containerAnnotations {
+		if container := strings.TrimSuffix(key, "."+annotation); container != key {
+			return container, annotation, true
+		}
+	}
+	return "", "", false
+}
+
+// target is a container of the application the truststores are injected to
+type target struct {
+	// init is true for an init container
+	init bool
+	// index is the index of the container in the containers or init containers of the pod
+	index int
+	// settings are the effective settings of the container
+	settings *Settings
+}
+
+// container returns the container of the pod being patched
+func (t target) container(pod *corev1.Pod) *corev1.Container {
+	if t.init {
+		return &pod.Spec.InitContainers[t.index]
+	}
+	return &pod.Spec.Containers[t.index]
+}
+
+// path returns the JSON patch path of a field of the container
+func (t target) path(field string) string {
+	if t.init {
+		return fmt.Sprintf("/spec/initContainers/%d/%s", t.index, field)
+	}
+	return fmt.Sprintf("/spec/containers/%d/%s", t.index, field)
+}
+
+// selected reports if the settings select the container for the injection
+func (s *Settings) selected(name string) bool {
+	for _, excluded := range s.ExcludeContainers {
+		if name == excluded {
+			return false
+		}
+	}
+	if len(s.Containers) == 0 {
+		return true
+	}
+	for _, included := range s.Containers {
+		if name == included {
+			return true
+		}
+	}
+	return false
+}
+
+// forContainer returns the settings of the container, i.e. the settings of the pod with the overrides of the container
+func (s *Settings) forContainer(annotations map[string]string, name string) (*Settings, error) {
+	c := *s
+	toggles := []struct {
+		annotation string
+		value      *bool
+	}{
+		{AnnotationCaPemInject, &c.InjectPem},
+		{AnnotationCaJksInject, &c.InjectJks},
+		{AnnotationCaPkcs12Inject, &c.InjectPkcs12},
+	}
+	for _, toggle := range toggles {
+		annotation := containerAnnotation(name, toggle.annotation)
+		if value, ok := annotations[annotation]; ok {
+			inject, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, &annotationError{annotation, value, "must be true or false"}
+			}
+			*toggle.value = inject
+		}
+	}
+	if pemPath, ok := annotations[containerAnnotation(name, AnnotationCaPemInjectPath)]; ok {
+		c.InjectPemPath = pemPath
+	}
+	if jksPath, ok := annotations[containerAnnotation(name, AnnotationCaJksInjectPath)]; ok {
+		c.InjectJksPath = jksPath
+	}
+	if pkcs12Path, ok := annotations[containerAnnotation(name, AnnotationCaPkcs12InjectPath)]; ok {
+		c.InjectPkcs12Path = pkcs12Path
+	}
+	if mode, ok := annotations[containerAnnotation(name, AnnotationMountMode)]; ok {
+		c.MountMode = mode
+	}
+	if policy, ok := annotations[containerAnnotation(name, AnnotationMountConflict)]; ok {
+		c.MountConflict = policy
+	}
+	if env, ok := annotations[containerAnnotation(name, AnnotationInjectEnv)]; ok {
+		c.InjectEnv = SplitList(env)
+	}
+	return &c, nil
+}
+
+// targets returns the containers and the init containers of the application selected for the injection
+// The init containers generating the truststores, given by generated, and the ones running before them are never selected
+func targets(pod *corev1.Pod, in *Settings, generated map[string]bool) ([]target, error) {
+	// the init containers before this index run before the truststores are generated
+	generator, _ := placementIndex(pod, in.InitContainerPlacement)
+	for i, c := range pod.Spec.InitContainers {
+		if generated[c.Name] {
+			generator = i
+			break
+		}
+	}
+
+	var ts []target
+	add := func(init bool, index int, name string) error {
+		if !in.selected(name) || (init && generated[name]) {
+			return nil
+		}
+		settings, err := in.forContainer(pod.ObjectMeta.Annotations, name)
+		if err != nil {
+			return err
+		}
+		// the truststores do not exist yet: an empty directory would hide the CAs of the image and the environment
+		// would point at missing files, and in file mode the kubelet would create a directory in place of the file
+		if init && index < generator {
+			log.Warnf("Init container %s runs before the truststores are generated, they are not injected to it", name)
+			return nil
+		}
+		ts = append(ts, target{init: init, index: index, settings: settings})
+		return nil
+	}
+	for i, c := range pod.Spec.Containers {
+		if err := add(false, i, c.Name); err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range pod.Spec.InitContainers {
+		if err := add(true, i, c.Name); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// anyTarget reports if the truststore of inject is injected to any of the targets
+func anyTarget(ts []target, inject func(*Settings) bool) bool {
+	for _, t := range ts {
+		if inject(t.settings) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateContainerNames(value string) string {
+	for _, name := range SplitList(value) {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			return fmt.Sprintf("%q is not a valid container name: %s", name, strings.Join(msgs, ", "))
+		}
+	}
+	return ""
+}
@@ -1,6 +1,32 @@
 package mutate
 
-type injection struct {
-	injectPem bool
-	injectJks bool
+import (
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// review holds an admission request together with the AdmissionReview version it was sent in
+type review struct {
+	version schema.GroupVersion
+	request *admissionv1.AdmissionRequest
+}
+
+// decision is the outcome of the admission of a pod
+type decision struct {
+	response *admissionv1.AdmissionResponse
+	// result is recorded in the metrics
+	result string
+	// settings are the effective settings of the pod, nil if the pod was not initialized
+	settings *Settings
+	// containers are the effective settings of the containers selected for the injection, by name
+	containers map[string]*Settings
+	// injections are the formats of the truststores injected by the patch, counted once it is sent
+	injections []string
+}
+
+// generator is a truststore format and the init containers generating it
+type generator struct {
+	format     string
+	containers []corev1.Container
 }
@@ -0,0 +1,430 @@
+package mutate
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/radudd/custom-ca-inject/pkg/metrics"
+	"github.com/radudd/custom-ca-inject/pkg/truststore"
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// imageReference matches a container image reference, following the grammar of
+// github.com/docker/distribution/reference: [domain[:port]/]path[:tag][@digest]
+var imageReference = func() *regexp.Regexp {
+	domainComponent := `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domain := domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+	pathComponent := `[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*`
+	name := `(?:` + domain + `/)?` + pathComponent + `(?:/` + pathComponent + `)*`
+	tag := `[\w][\w.-]{0,127}`
+	digest := `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	return regexp.MustCompile(`^` + name + `(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// annotationValidators check the value of each annotation, returning why it is invalid
+var annotationValidators = map[string]func(string) string{
+	AnnotationCaPemInject:                validateToggle,
+	AnnotationCaJksInject:                validateToggle,
+	AnnotationProfile:                    validateProfile,
+	AnnotationCaPemInjectPath:            validateMountPath,
+	AnnotationCaJksInjectPath:            validateMountPath,
+	AnnotationCaPkcs12Inject:             validateToggle,
+	AnnotationCaPkcs12InjectPath:         validateMountPath,
+	AnnotationMountMode:                  validateMountMode,
+	AnnotationMountConflict:              validateMountConflict,
+	AnnotationEmptyDirMedium:             validateEmptyDirMedium,
+	AnnotationEmptyDirSizeLimit:          optional(validateQuantity),
+	AnnotationContainers:                 validateContainerNames,
+	AnnotationExcludeContainers:          validateContainerNames,
+	AnnotationImage:                      validateImage,
+	AnnotationImagePullPolicy:            optional(validatePullPolicy),
+	AnnotationImagePullSecrets:           validatePullSecrets,
+	AnnotationInitContainerPlacement:     validatePlacement,
+	AnnotationRestrictedInitContainers:   validateToggle,
+	AnnotationInitContainerCPURequest:    optional(validateQuantity),
+	AnnotationInitContainerMemoryRequest: optional(validateQuantity),
+	AnnotationInitContainerCPULimit:      optional(validateQuantity),
+	AnnotationInitContainerMemoryLimit:   optional(validateQuantity),
+	AnnotationConfigMap:                  validateObjectName,
+	AnnotationNamePrefix:                 validateNamePrefix,
+	AnnotationInjectedNames:              validateInjectedNames,
+	AnnotationPasswordSecret:             optional(validateObjectName),
+	AnnotationPasswordSecretKey:          validateSecretKey,
+	AnnotationPasswordEnv:                optional(validateEnvName),
+	AnnotationInjectEnv:                  validateEnvList,
+	AnnotationRegexCn:                    validateRegex,
+	AnnotationRegexIssuer:                validateRegex,
+	AnnotationRegexIssuerDeny:            validateRegex,
+	AnnotationFingerprintAllow:           validateFingerprints,
+	AnnotationFingerprintDeny:            validateFingerprints,
+}
+
+func validateToggle(value string) string {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return "must be true or false"
+	}
+	return ""
+}
+
+func validateMountPath(value string) string {
+	if !path.IsAbs(value) {
+		return "must be an absolute path"
+	}
+	if path.Clean(value) == "/" {
+		return "must not be the root directory"
+	}
+	for _, element := range strings.Split(value, "/") {
+		if element == ".." {
+			return "must not contain '..'"
+		}
+	}
+	return ""
+}
+
+func validateMountMode(value string) string {
+	if value != MountModeDirectory && value != MountModeFile {
+		return "must be directory or file"
+	}
+	return ""
+}
+
+func validateMountConflict(value string) string {
+	switch value {
+	case MountConflictSkip, MountConflictReplace, MountConflictDeny:
+		return ""
+	}
+	return "must be skip, replace or deny"
+}
+
+func validateImage(value string) string {
+	if len(value) > 255 || !imageReference.MatchString(value) {
+		return "must be a valid image reference, e.g. registry.example.com/ubi8/openjdk-11:latest"
+	}
+	return ""
+}
+
+func validatePullPolicy(value string) string {
+	switch corev1.PullPolicy(value) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return ""
+	}
+	return "must be Always, IfNotPresent or Never"
+}
+
+func validatePullSecrets(value string) string {
+	for _, name := range SplitList(value) {
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			return fmt.Sprintf("%q is not a valid secret name: %s", name, strings.Join(msgs, ", "))
+		}
+	}
+	return ""
+}
+
+func validatePlacement(value string) string {
+	if value == PlacementFirst || value == PlacementLast {
+		return ""
+	}
+	if name := strings.TrimPrefix(value, placementBefore); name != value && len(validation.IsDNS1123Label(name)) == 0 {
+		return ""
+	}
+	return "must be first, last or before:<name> of an init container"
+}
+
+func validateObjectName(value string) string {
+	if msgs := validation.IsDNS1123Subdomain(value); len(msgs) > 0 {
+		return strings.Join(msgs, ", ")
+	}
+	return ""
+}
+
+func validateSecretKey(value string) string {
+	if msgs := validation.IsConfigMapKey(value); len(msgs) > 0 {
+		return strings.Join(msgs, ", ")
+	}
+	return ""
+}
+
+func validateEnvName(value string) string {
+	if msgs := validation.IsEnvVarName(value); len(msgs) > 0 {
+		return strings.Join(msgs, ", ")
+	}
+	return ""
+}
+
+// optional accepts an empty value, which disables the setting, besides the values accepted by validate
+func optional(validate func(string) string) func(string) string {
+	return func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return validate(value)
+	}
+}
+
+func validateRegex(value string) string {
+	if _, err := regexp.Compile(value); err != nil {
+		return fmt.Sprintf("must be a valid regular expression: %v", err)
+	}
+	return ""
+}
+
+func validateFingerprints(value string) string {
+	for _, fp := range SplitList(value) {
+		if _, err := truststore.NormalizeFingerprint(fp); err != nil {
+			return fmt.Sprintf("must be a comma separated list of SHA-256 fingerprints, %q is not 64 hex digits optionally separated by colons", fp)
+		}
+	}
+	return ""
+}
+
+// validateAnnotations returns an error for each injection annotation of the pod with an invalid value
+func validateAnnotations(pod *corev1.Pod) []error {
+	var errs []error
+	for annotation, validate := range annotationValidators {
+		value, ok := pod.ObjectMeta.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		if reason := validate(value); reason != "" {
+			errs = append(errs, &annotationError{annotation, value, reason})
+		}
+	}
+	// a request above its limit is rejected by the API server with an error not naming the injector
+	in := currentSettings()
+	for _, b := range in.initContainerResourceBounds() {
+		request, requestSet := pod.ObjectMeta.Annotations[b.requestAnnotation]
+		limit, limitSet := pod.ObjectMeta.Annotations[b.limitAnnotation]
+		if requestSet {
+			*b.request = request
+		}
+		if limitSet {
+			*b.limit = limit
+		}
+		switch {
+		case !b.exceeded():
+		case limitSet:
+			errs = append(errs, &annotationError{b.limitAnnotation, limit, fmt.Sprintf("must not be below the %s request %s", b.resource, *b.request)})
+		case requestSet:
+			errs = append(errs, &annotationError{b.requestAnnotation, request, fmt.Sprintf("must not exceed the %s limit %s", b.resource, *b.limit)})
+		}
+	}
+	// the init containers generating the truststores cannot be placed before a missing init container
+	placement, placementSet := pod.ObjectMeta.Annotations[AnnotationInitContainerPlacement]
+	if !placementSet {
+		placement = in.InitContainerPlacement
+	}
+	if name := strings.TrimPrefix(placement, placementBefore); name != placement && validatePlacement(placement) == "" {
+		if _, found := placementIndex(pod, placement); !found && placementSet {
+			errs = append(errs, &annotationError{AnnotationInitContainerPlacement, placement, fmt.Sprintf("init container %s is not in the pod", name)})
+		} else if !found {
+			errs = append(errs, fmt.Errorf("init container %s of the initContainerPlacement setting %q is not in the pod", name, placement))
+		}
+	}
+	if value, ok := pod.ObjectMeta.Labels[LabelInject]; ok && value != "true" && value != "false" {
+		errs = append(errs, fmt.Errorf("invalid value %q for label %s: must be true or false", value, LabelInject))
+	}
+	// the overrides of a container follow the rules of the annotation they override
+	for key, value := range pod.ObjectMeta.Annotations {
+		container, annotation, ok := splitContainerAnnotation(key)
+		if !ok {
+			continue
+		}
+		if msgs := validation.IsDNS1123Label(container); len(msgs) > 0 {
+			errs = append(errs, &annotationError{key, value, fmt.Sprintf("%q is not a valid container name", container)})
+		} else if reason := annotationValidators[annotation](value); reason != "" {
+			errs = append(errs, &annotationError{key, value, reason})
+		}
+	}
+	// the paths are only resolved once every annotation is valid
+	if len(errs) == 0 {
+		errs = append(sharedMountPaths(pod), javaPasswordWithoutSecret(pod)...)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return errs
+}
+
+// sharedMountPaths returns an error if the settings of the pod, or else of a container with overrides,
+// mount two truststores at the same path, where one would hide the other
+func sharedMountPaths(pod *corev1.Pod) []error {
+	in, err := initialize(pod, nil)
+	if err != nil {
+		return []error{err}
+	}
+	if err := sharedMountPath(pod, in, ""); err != nil {
+		return []error{err}
+	}
+	containers := map[string]bool{}
+	for key := range pod.ObjectMeta.Annotations {
+		if container, _, ok := splitContainerAnnotation(key); ok {
+			containers[container] = true
+		}
+	}
+	var errs []error
+	for container := range containers {
+		c, err := in.forContainer(pod.ObjectMeta.Annotations, container)
+		if err == nil {
+			err = sharedMountPath(pod, c, container)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// javaPasswordWithoutSecret returns an error for the inject-env annotations of the pod and its containers using the
+// java-password preset, if there is no password secret or no password-env variable to read the password from
+func javaPasswordWithoutSecret(pod *corev1.Pod) []error {
+	in, err := initialize(pod, nil)
+	if err != nil {
+		return []error{err}
+	}
+	if in.PasswordSecret != "" && in.PasswordEnv != "" {
+		return nil
+	}
+	reason := fmt.Sprintf("the %s preset needs the %s and %s annotations", javaPasswordPreset, AnnotationPasswordSecret, AnnotationPasswordEnv)
+	var errs []error
+	for key, value := range pod.ObjectMeta.Annotations {
+		if _, annotation, ok := splitContainerAnnotation(key); key != AnnotationInjectEnv && (!ok || annotation != AnnotationInjectEnv) {
+			continue
+		}
+		for _, entry := range SplitList(value) {
+			if entry == javaPasswordPreset {
+				errs = append(errs, &annotationError{key, value, reason})
+				break
+			}
+		}
+	}
+	if _, ok := pod.ObjectMeta.Annotations[AnnotationInjectEnv]; !ok {
+		for _, entry := range in.InjectEnv {
+			if entry == javaPasswordPreset {
+				errs = append(errs, fmt.Errorf("the %s preset of the injectEnv setting needs the %s and %s annotations", javaPasswordPreset, AnnotationPasswordSecret, AnnotationPasswordEnv))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// sharedMountPath returns an error naming the path annotation of the container, or of the pod, mounting a truststore
+// where the truststore of another format is mounted
+func sharedMountPath(pod *corev1.Pod, s *Settings, container string) error {
+	first, second, ok := s.sharedMountPath()
+	if !ok {
+		return nil
+	}
+	for _, pair := range [][2]truststoreFormat{{second, first}, {first, second}} {
+		annotations := []string{pair[0].pathAnnotation}
+		if container != "" {
+			annotations = []string{containerAnnotation(container, pair[0].pathAnnotation), pair[0].pathAnnotation}
+		}
+		for _, annotation := range annotations {
+			if value, ok := pod.ObjectMeta.Annotations[annotation]; ok {
+				return &annotationError{annotation, value, fmt.Sprintf("must not mount the %s truststore at %s, where the %s truststore is mounted", pair[0].label, pair[0].mountPath(s), pair[1].label)}
+			}
+		}
+	}
+	// the paths of the settings only collide with the mount mode of the annotations
+	return fmt.Errorf("the %s and %s truststores are both mounted at %s with the %s mount mode", first.label, second.label, first.mountPath(s), s.MountMode)
+}
+
+// injectionMetadata returns the injection annotations and label of the pod, those checked by validateAnnotations
+func injectionMetadata(pod *corev1.Pod) map[string]string {
+	metadata := map[string]string{}
+	for key, value := range pod.ObjectMeta.Annotations {
+		if _, ok := annotationValidators[key]; ok {
+			metadata[key] = value
+		} else if _, _, ok := splitContainerAnnotation(key); ok {
+			metadata[key] = value
+		}
+	}
+	if value, ok := pod.ObjectMeta.Labels[LabelInject]; ok {
+		metadata[LabelInject] = value
+	}
+	return metadata
+}
+
+// invalidAnnotations denies the pod with a message listing every invalid annotation
+func invalidAnnotations(errs []error) *admissionv1.AdmissionResponse {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, strings.Join(msgs, "; "))
+}
+
+// Validate answers the AdmissionReview sent to the validating webhook
+// Pods with malformed injection annotations are denied, the others are allowed
+// An error is only returned if the body is not an AdmissionReview and there is no request to answer
+func Validate(body []byte) ([]byte, error) {
+	log.Debug(string(body))
+
+	// record the outcome of the request, anything returning early is an error
+	start := time.Now()
+	result := metrics.ResultErrored
+	defer func() {
+		metrics.ObserveValidation(result, start)
+	}()
+
+	ar, err := decodeReview(body)
+	if err != nil {
+		metrics.DecodeFailures.Inc()
+		log.Error(err.Error())
+		return nil, err
+	}
+	if ar.request == nil {
+		log.Error("AdmissionReview is empty")
+		return nil, fmt.Errorf("AdmissionReview is empty")
+	}
+
+	d := validate(ar.request)
+	d.response.UID = ar.request.UID
+	responseBody, err := ar.encode(d.response)
+	if err != nil {
+		return nil, err
+	}
+	result = d.result
+	return responseBody, nil
+}
+
+func validate(request *admissionv1.AdmissionRequest) *decision {
+	pod := &corev1.Pod{}
+	if _, _, err := codecs.UniversalDeserializer().Decode(request.Object.Raw, nil, pod); err != nil {
+		metrics.DecodeFailures.Inc()
+		log.Errorf("Unable to unmarshal json to a Pod object %v", err)
+		return &decision{response: denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("Unable to decode the Pod: %v", err)), result: metrics.ResultErrored}
+	}
+	if optedOut(pod) {
+		return &decision{response: allowed(), result: metrics.ResultAllowed}
+	}
+	// an update keeping the annotations of the pod, e.g. removing a finalizer, is allowed even if they are malformed
+	if request.Operation == admissionv1.Update {
+		old := &corev1.Pod{}
+		if _, _, err := codecs.UniversalDeserializer().Decode(request.OldObject.Raw, nil, old); err != nil {
+			metrics.DecodeFailures.Inc()
+			log.Errorf("Unable to unmarshal json to a Pod object %v", err)
+			return &decision{response: denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("Unable to decode the old Pod: %v", err)), result: metrics.ResultErrored}
+		}
+		if reflect.DeepEqual(injectionMetadata(old), injectionMetadata(pod)) {
+			return &decision{response: allowed(), result: metrics.ResultAllowed}
+		}
+	}
+	if errs := validateAnnotations(pod); len(errs) > 0 {
+		log.Infof("Rejecting pod %s with invalid annotations", getPodName(pod))
+		return &decision{response: invalidAnnotations(errs), result: metrics.ResultDenied}
+	}
+	return &decision{response: allowed(), result: metrics.ResultAllowed}
+}
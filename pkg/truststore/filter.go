@@ -0,0 +1,118 @@
+package truststore
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter selects the certificates of a bundle
+// A certificate is selected if it matches all the configured allow rules and none of the deny rules
+type Filter struct {
+	// CommonName must match the subject CN
+	CommonName *regexp.Regexp
+	// Issuer must match the issuer DN, e.g. CN=Corp Root CA,O=Corp
+	Issuer *regexp.Regexp
+	// IssuerDeny must not match the issuer DN
+	IssuerDeny *regexp.Regexp
+	// FingerprintAllow lists the only SHA-256 fingerprints selected, all if empty
+	FingerprintAllow map[string]bool
+	// FingerprintDeny lists the SHA-256 fingerprints never selected
+	FingerprintDeny map[string]bool
+}
+
+// NewFilter compiles the rules of a Filter, empty values disable the rule
+func NewFilter(commonName, issuer, issuerDeny string, fingerprintAllow, fingerprintDeny []string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	if f.CommonName, err = compile("CN regex", commonName); err != nil {
+		return nil, err
+	}
+	if f.Issuer, err = compile("issuer regex", issuer); err != nil {
+		return nil, err
+	}
+	if f.IssuerDeny, err = compile("issuer deny regex", issuerDeny); err != nil {
+		return nil, err
+	}
+	if f.FingerprintAllow, err = fingerprintSet(fingerprintAllow); err != nil {
+		return nil, err
+	}
+	if f.FingerprintDeny, err = fingerprintSet(fingerprintDeny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func compile(name, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", name, err)
+	}
+	return re, nil
+}
+
+func fingerprintSet(fingerprints []string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, fp := range fingerprints {
+		normalized, err := NormalizeFingerprint(fp)
+		if err != nil {
+			return nil, err
+		}
+		set[normalized] = true
+	}
+	return set, nil
+}
+
+// NormalizeFingerprint accepts a SHA-256 fingerprint in hex, with or without colons and in any case
+// and returns it in the format of Fingerprint
+func NormalizeFingerprint(fp string) (string, error) {
+	raw := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+	if decoded, err := hex.DecodeString(raw); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("Invalid SHA-256 fingerprint %q: must be 64 hex digits, optionally separated by colons", fp)
+	}
+	return raw, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate as lower case hex
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Match reports if the certificate is selected by the filter
+func (f *Filter) Match(cert *x509.Certificate) bool {
+	fp := Fingerprint(cert)
+	if f.FingerprintDeny[fp] {
+		return false
+	}
+	if f.IssuerDeny != nil && f.IssuerDeny.MatchString(cert.Issuer.String()) {
+		return false
+	}
+	if len(f.FingerprintAllow) > 0 && !f.FingerprintAllow[fp] {
+		return false
+	}
+	if f.Issuer != nil && !f.Issuer.MatchString(cert.Issuer.String()) {
+		return false
+	}
+	if f.CommonName != nil && !f.CommonName.MatchString(cert.Subject.CommonName) {
+		return false
+	}
+	return true
+}
+
+// Select returns the certificates matched by the filter, in their original order
+func (f *Filter) Select(certs []*x509.Certificate) []*x509.Certificate {
+	var selected []*x509.Certificate
+	for _, cert := range certs {
+		if f.Match(cert) {
+			selected = append(selected, cert)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,61 @@
+package truststore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	jksMagic          = 0xfeedfeed
+	jksVersion        = 2
+	jksTrustedCertTag = 2
+	// jksWhitener is mixed into the integrity digest of the keystore by the JDK
+	jksWhitener = "Mighty Aphrodite"
+)
+
+// EncodeJKS returns the entries as a JKS truststore protected by password
+// Only trusted certificate entries are written, which is all a truststore holds
+func EncodeJKS(entries []Entry, password string, created time.Time) ([]byte, error) {
+	var out bytes.Buffer
+	write := func(v interface{}) {
+		binary.Write(&out, binary.BigEndian, v)
+	}
+	writeUTF := func(s string) error {
+		if len(s) > 0xffff {
+			return fmt.Errorf("%q is too long for a JKS truststore", s)
+		}
+		write(uint16(len(s)))
+		out.WriteString(s)
+		return nil
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(len(entries)))
+	for _, entry := range entries {
+		write(uint32(jksTrustedCertTag))
+		if err := writeUTF(entry.Alias); err != nil {
+			return nil, err
+		}
+		write(created.UnixNano() / int64(time.Millisecond))
+		if err := writeUTF("X.509"); err != nil {
+			return nil, err
+		}
+		write(uint32(len(entry.Certificate.Raw)))
+		out.Write(entry.Certificate.Raw)
+	}
+
+	// the digest covers the password as UTF-16, the whitener and the whole keystore
+	digest := sha1.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		binary.Write(digest, binary.BigEndian, c)
+	}
+	digest.Write([]byte(jksWhitener))
+	digest.Write(out.Bytes())
+	out.Write(digest.Sum(nil))
+	return out.Bytes(), nil
+}
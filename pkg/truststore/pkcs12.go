@@ -0,0 +1,214 @@
+package truststore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+var (
+	oidDataContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	// oidJavaTrustedKeyUsage marks the certificates Java loads as trusted entries of a PKCS#12 keystore
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+)
+
+const (
+	pkcs12MacIterations = 10000
+	pkcs12SaltLength    = 16
+)
+
+// the ASN.1 structures of RFC 7292, limited to what a truststore needs
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// explicit wraps DER in the [0] EXPLICIT tag used by the content of the structures above
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// dataContentInfo wraps DER in a ContentInfo of type data
+func dataContentInfo(der []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicit(octets)}, nil
+}
+
+// attribute returns a PKCS#12 attribute with a single value
+func attribute(id asn1.ObjectIdentifier, value interface{}) (pkcs12Attribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{ID: id, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}}, nil
+}
+
+// bmpString encodes s as UTF-16 big endian, the encoding of the PKCS#12 strings and passwords
+func bmpString(s string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return out
+}
+
+// EncodePKCS12 returns the entries as a PKCS#12 truststore whose integrity is protected by password
+// The certificates are not encrypted, as a truststore holds no secret, and are marked as trusted for Java
+func EncodePKCS12(entries []Entry, password string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("The password of a PKCS#12 truststore must not be empty")
+	}
+	var bags []safeBag
+	for _, entry := range entries {
+		bag, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: entry.Certificate.Raw})
+		if err != nil {
+			return nil, err
+		}
+		name, err := attribute(oidFriendlyName, asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(entry.Alias)})
+		if err != nil {
+			return nil, err
+		}
+		trusted, err := attribute(oidJavaTrustedKeyUsage, oidAnyExtendedKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, safeBag{ID: oidCertBag, Value: explicit(bag), Attributes: []pkcs12Attribute{name, trusted}})
+	}
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+	safe, err := dataContentInfo(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{safe})
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := dataContentInfo(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, pkcs12SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	// the password is a null terminated BMPString
+	key := pkcs12KDF(sha1.New, 64, salt, append(bmpString(password), 0, 0), pkcs12MacIterations, sha1.Size, 3)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authenticatedSafe)
+
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: authSafe,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12MacIterations,
+		},
+	})
+}
+
+// pkcs12KDF derives size bytes of key material as described in RFC 7292 appendix B.2
+// v is the block size of the hash and id the purpose of the key, 3 for the MAC key
+func pkcs12KDF(newHash func() hash.Hash, v int, salt, password []byte, iterations, size int, id byte) []byte {
+	// fill repeats b into a multiple of v bytes
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	diversifier := make([]byte, v)
+	for i := range diversifier {
+		diversifier[i] = id
+	}
+	input := append(fill(salt), fill(password)...)
+
+	var key []byte
+	for {
+		h := newHash()
+		h.Write(diversifier)
+		h.Write(input)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		key = append(key, a...)
+		if len(key) >= size {
+			return key[:size]
+		}
+
+		// add B+1 to every block of the input for the next round
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(input); j += v {
+			block := new(big.Int).SetBytes(input[j : j+v])
+			sum := block.Add(block, b).Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			copy(input[j:j+v], make([]byte, v-len(sum)))
+			copy(input[j+v-len(sum):j+v], sum)
+		}
+	}
+}
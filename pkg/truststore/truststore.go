@@ -0,0 +1,70 @@
+package truststore
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Entry is a trusted certificate of a truststore
+type Entry struct {
+	// Alias names the certificate in the JKS truststore
+	Alias string
+	// Certificate is the trusted certificate
+	Certificate *x509.Certificate
+}
+
+var aliasInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// alias derives the alias of a certificate from its subject CN
+// Java lower cases aliases, so they are generated in lower case to stay unique
+func alias(cert *x509.Certificate) string {
+	a := strings.Trim(aliasInvalid.ReplaceAllString(strings.ToLower(cert.Subject.CommonName), "-"), "-.")
+	if a == "" {
+		return Fingerprint(cert)[:16]
+	}
+	return a
+}
+
+// Merge returns the entries of the bundles, in their original order and without duplicates
+// Certificates are identical if their DER encoding is, whatever the whitespace or comments of the PEM
+// Aliases derived from the same CN are made unique with a numbered suffix
+func Merge(bundles ...[]*x509.Certificate) []Entry {
+	var entries []Entry
+	seen := map[string]bool{}
+	aliases := map[string]bool{}
+	for _, bundle := range bundles {
+		for _, cert := range bundle {
+			fp := Fingerprint(cert)
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+
+			a := alias(cert)
+			for i := 2; aliases[a]; i++ {
+				a = fmt.Sprintf("%s-%d", alias(cert), i)
+			}
+			aliases[a] = true
+			entries = append(entries, Entry{Alias: a, Certificate: cert})
+		}
+	}
+	return entries
+}
+
+// Certificates returns the certificates of the entries
+func Certificates(entries []Entry) []*x509.Certificate {
+	certs := make([]*x509.Certificate, 0, len(entries))
+	for _, entry := range entries {
+		certs = append(certs, entry.Certificate)
+	}
+	return certs
+}
+
+const (
+	// DefaultPassword protects the JKS and PKCS#12 truststores unless a password is given
+	DefaultPassword = "changeit"
+	// PasswordEnv is the environment variable passing the password of the truststores to the build-truststore command
+	PasswordEnv = "TRUSTSTORE_PASSWORD"
+)
@@ -0,0 +1,77 @@
+package truststore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func aliases(entries []Entry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Alias)
+	}
+	return names
+}
+
+func TestMergeDedupesByDER(t *testing.T) {
+	root := newTestCA(t, "Corp Root CA", "Corp Root CA")
+	issuing := newTestCA(t, "Corp Root CA", "Corp Root CA")
+	unnamed := newTestCA(t, "", "Corp Root CA")
+
+	// the same CA with different whitespace in the PEM is merged once
+	reformatted, err := ParsePEM(append([]byte("\n\n"), bytes.ReplaceAll(EncodePEM([]*x509.Certificate{root}), []byte("\n"), []byte("\r\n"))...))
+	assert.NoError(t, err)
+
+	entries := Merge([]*x509.Certificate{root}, append(reformatted, issuing, unnamed))
+	assert.Equal(t, []string{"corp-root-ca", "corp-root-ca-2", Fingerprint(unnamed)[:16]}, aliases(entries))
+	assert.Equal(t, []*x509.Certificate{root, issuing, unnamed}, Certificates(entries))
+}
+
+func TestEncodeJKS(t *testing.T) {
+	entries := Merge([]*x509.Certificate{newTestCA(t, "Corp Payments CA", "Corp Root CA"), newTestCA(t, "Corp HR CA", "Corp Root CA")})
+	created := time.Date(2020, 10, 24, 0, 0, 0, 0, time.UTC)
+	jks, err := EncodeJKS(entries, "changeit", created)
+	assert.NoError(t, err)
+
+	// an independent reader checks the digest and reads the trusted certificate entries
+	ks := keystore.New()
+	assert.NoError(t, ks.Load(bytes.NewReader(jks), []byte("changeit")))
+	assert.ElementsMatch(t, aliases(entries), ks.Aliases())
+	for _, entry := range entries {
+		trusted, err := ks.GetTrustedCertificateEntry(entry.Alias)
+		assert.NoError(t, err)
+		assert.True(t, created.Equal(trusted.CreationTime))
+		assert.Equal(t, "X.509", trusted.Certificate.Type)
+		assert.Equal(t, entry.Certificate.Raw, trusted.Certificate.Content)
+	}
+	assert.Error(t, keystore.New().Load(bytes.NewReader(jks), []byte("letmein")))
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// 24 bytes need two rounds of SHA-1, the expected key is derived by openssl
+	key := pkcs12KDF(sha1.New, 64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, append(bmpString("sesame"), 0, 0), 2048, 24, 1)
+	assert.Equal(t, []byte("\x7c\xd9\xfd\x3e\x2b\x3b\xe7\x69\x1a\x44\xe3\xbe\xf0\xf9\xea\x0f\xb9\xb8\x97\xd4\xe3\x25\xd9\xd1"), key)
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	entries := Merge([]*x509.Certificate{newTestCA(t, "Corp Payments CA", "Corp Root CA"), newTestCA(t, "Corp HR CA", "Corp Root CA")})
+	der, err := EncodePKCS12(entries, "changeit")
+	assert.NoError(t, err)
+
+	// an independent decoder checks the MAC and reads the certificates marked as trusted for Java
+	certs, err := pkcs12.DecodeTrustStore(der, "changeit")
+	assert.NoError(t, err)
+	assert.Equal(t, Certificates(entries), certs)
+	_, err = pkcs12.DecodeTrustStore(der, "letmein")
+	assert.Equal(t, pkcs12.ErrIncorrectPassword, err)
+
+	_, err = EncodePKCS12(entries, "")
+	assert.Error(t, err)
+}
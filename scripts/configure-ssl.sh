@@ -15,3 +15,6 @@ caBundle=$(oc get cm service-cacert -o jsonpath='{.data.service-ca\.crt}'|base64
 
 # Update the MutatingWebhookConfig
 oc patch "${kind:-mutatingwebhookconfiguration}" custom-ca-injector-pki --type='json' -p "[{'op': 'add', 'path': '/webhooks/0/clientConfig/caBundle', 'value':'${caBundle}'}]"
+
+# Update the ValidatingWebhookConfig
+oc patch validatingwebhookconfiguration custom-ca-injector-validation --type='json' -p "[{'op': 'add', 'path': '/webhooks/0/clientConfig/caBundle', 'value':'${caBundle}'}]"